@@ -1,50 +1,298 @@
 package abi
 
 import (
+	"context"
+	"embed"
+	"fmt"
 	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 
-	"github.com/holiman/uint256"
+	ethabi "github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/status-im/keycard-go/hexutils"
 	"psm-monitor/misc"
 	"psm-monitor/net"
 )
 
-func PadUint256(num uint64) string {
-	return hexutils.BytesToHex(uint256.NewInt(num).PaddedBytes(32))
+//go:embed abis/*.json
+var embedded embed.FS
+
+var (
+	loaded     = make(map[string]*ethabi.ABI)
+	loadedLock sync.Mutex
+)
+
+// Load returns the embedded ABI with the given name, e.g. "erc20" for abis/erc20.json
+func Load(name string) (*ethabi.ABI, error) {
+	loadedLock.Lock()
+	defer loadedLock.Unlock()
+	if contractABI, ok := loaded[name]; ok {
+		return contractABI, nil
+	}
+	data, err := embedded.ReadFile("abis/" + name + ".json")
+	if err != nil {
+		return nil, err
+	}
+	contractABI, err := ethabi.JSON(strings.NewReader(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("abi: parse %s: %w", name, err)
+	}
+	loaded[name] = &contractABI
+	return &contractABI, nil
+}
+
+// MustLoad is like Load but panics if the embedded ABI is missing or broken
+func MustLoad(name string) *ethabi.ABI {
+	contractABI, err := Load(name)
+	if err != nil {
+		panic(err)
+	}
+	return contractABI
+}
+
+// LoadFile parses an ABI JSON file, e.g. one exported from tronscan
+func LoadFile(path string) (*ethabi.ABI, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	contractABI, err := ethabi.JSON(file)
+	if err != nil {
+		return nil, fmt.Errorf("abi: parse %s: %w", path, err)
+	}
+	return &contractABI, nil
+}
+
+// Contract binds an ABI to a deployed contract for constant calls.
+type Contract struct {
+	Addr string
+
+	chain net.ChainProvider
+	abi   *ethabi.ABI
+}
+
+func NewContract(chain net.ChainProvider, addr string, contractABI *ethabi.ABI) *Contract {
+	return &Contract{Addr: addr, chain: chain, abi: contractABI}
+}
+
+// Call triggers a constant method and returns its decoded outputs,
+// tron base58 addresses are accepted as address arguments and returned for address outputs.
+func (c *Contract) Call(ctx context.Context, method string, args ...interface{}) ([]interface{}, error) {
+	m, ok := c.abi.Methods[method]
+	if !ok {
+		return nil, fmt.Errorf("abi: method %s not found", method)
+	}
+	param, err := EncodeArgs(m.Inputs, args...)
+	if err != nil {
+		return nil, fmt.Errorf("abi: encode %s: %w", m.Sig, err)
+	}
+	result, err := c.chain.Trigger(ctx, c.Addr, m.Sig, param)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := DecodeOutputs(m.Outputs, result)
+	if err != nil {
+		return nil, fmt.Errorf("abi: decode %s: %w", m.Sig, err)
+	}
+	return outputs, nil
+}
+
+// CallBigInt calls a method whose first output is an integer
+func (c *Contract) CallBigInt(ctx context.Context, method string, args ...interface{}) (*big.Int, error) {
+	outputs, err := c.Call(ctx, method, args...)
+	return bigIntOutput(method, outputs, err)
+}
+
+// CallAddress calls a method whose first output is an address
+func (c *Contract) CallAddress(ctx context.Context, method string, args ...interface{}) (string, error) {
+	outputs, err := c.Call(ctx, method, args...)
+	return addressOutput(method, outputs, err)
+}
+
+// pack returns the selector and encoded arguments of a method call, as sent in a multicall
+func (c *Contract) pack(method string, args ...interface{}) ([]byte, error) {
+	m, ok := c.abi.Methods[method]
+	if !ok {
+		return nil, fmt.Errorf("abi: method %s not found", method)
+	}
+	param, err := EncodeArgs(m.Inputs, args...)
+	if err != nil {
+		return nil, fmt.Errorf("abi: encode %s: %w", m.Sig, err)
+	}
+	return append(m.ID, common.FromHex(param)...), nil
 }
 
-func PadAddress(addr string) string {
-	return hexutils.BytesToHex(uint256.NewInt(0).SetBytes20(hexutils.HexToBytes(addr)).PaddedBytes(32))
+// unpack decodes the raw return data of a method call
+func (c *Contract) unpack(method string, data []byte) ([]interface{}, error) {
+	outputs, err := DecodeOutputs(c.abi.Methods[method].Outputs, hexutils.BytesToHex(data))
+	if err != nil {
+		return nil, fmt.Errorf("abi: decode %s: %w", c.abi.Methods[method].Sig, err)
+	}
+	return outputs, nil
+}
+
+// firstOutput returns the first output of a call, an error when the call failed or returned nothing,
+// e.g. a call of a multicall that was never sent
+func firstOutput(method string, outputs []interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("abi: %s returns no output", method)
+	}
+	return outputs[0], nil
+}
+
+func bigIntOutput(method string, outputs []interface{}, err error) (*big.Int, error) {
+	output, err := firstOutput(method, outputs, err)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := output.(*big.Int); ok {
+		return value, nil
+	}
+	return nil, fmt.Errorf("abi: %s returns %T, not an integer", method, output)
+}
+
+func bigIntOutputs(method string, outputs []interface{}, err error) ([]*big.Int, error) {
+	if _, err := firstOutput(method, outputs, err); err != nil {
+		return nil, err
+	}
+	values := make([]*big.Int, len(outputs))
+	for i, output := range outputs {
+		value, ok := output.(*big.Int)
+		if !ok {
+			return nil, fmt.Errorf("abi: %s returns %T at %d, not an integer", method, output, i)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func addressOutput(method string, outputs []interface{}, err error) (string, error) {
+	output, err := firstOutput(method, outputs, err)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := output.(string); ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("abi: %s returns %T, not an address", method, output)
+}
+
+// EncodeArgs packs the arguments into the hex parameter of a trigger call
+func EncodeArgs(inputs ethabi.Arguments, args ...interface{}) (string, error) {
+	if len(args) != len(inputs) {
+		return "", fmt.Errorf("want %d arguments, got %d", len(inputs), len(args))
+	}
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		converted[i] = toABIValue(inputs[i].Type, arg)
+	}
+	packed, err := inputs.Pack(converted...)
+	if err != nil {
+		return "", err
+	}
+	return hexutils.BytesToHex(packed), nil
+}
+
+// DecodeOutputs unpacks the hex result of a trigger call
+func DecodeOutputs(outputs ethabi.Arguments, result string) ([]interface{}, error) {
+	values, err := outputs.Unpack(common.FromHex(result))
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		values[i] = FromABIValue(values[i])
+	}
+	return values, nil
+}
+
+// toABIValue converts tron addresses and plain integers to the go types the ABI packer expects
+func toABIValue(t ethabi.Type, arg interface{}) interface{} {
+	switch t.T {
+	case ethabi.AddressTy:
+		if addr, ok := arg.(string); ok {
+			return common.HexToAddress(misc.ToHexAddr(addr))
+		}
+	case ethabi.IntTy, ethabi.UintTy:
+		if t.Size <= 64 {
+			return arg
+		}
+		switch v := arg.(type) {
+		case int:
+			return big.NewInt(int64(v))
+		case int64:
+			return big.NewInt(v)
+		case uint64:
+			return new(big.Int).SetUint64(v)
+		}
+	}
+	return arg
+}
+
+// FromABIValue converts addresses to tron base58 strings and integer arrays to slices
+func FromABIValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case common.Address:
+		return misc.ToTronAddr(v.Hex())
+	case []common.Address:
+		addrs := make([]string, len(v))
+		for i, addr := range v {
+			addrs[i] = misc.ToTronAddr(addr.Hex())
+		}
+		return addrs
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Array && rv.Type().Elem() == reflect.TypeOf(common.Address{}) {
+		addrs := make([]string, rv.Len())
+		for i := range addrs {
+			addrs[i] = misc.ToTronAddr(rv.Index(i).Interface().(common.Address).Hex())
+		}
+		return addrs
+	}
+	if rv.Kind() == reflect.Array && rv.Type().Elem() == reflect.TypeOf(&big.Int{}) {
+		nums := make([]*big.Int, rv.Len())
+		for i := range nums {
+			nums[i] = rv.Index(i).Interface().(*big.Int)
+		}
+		return nums
+	}
+	return value
 }
 
-func Coins(addr string, i uint64) string {
-	result, err := net.Trigger(addr, "coins(uint256)", PadUint256(i))
+func Coins(ctx context.Context, chain net.ChainProvider, addr string, i uint64) string {
+	coin, err := NewCurvePool(chain, addr).Coins(ctx, i)
 	if err != nil {
 		return ""
 	}
-	return misc.ToTronAddr(result[24:])
+	return coin
 }
 
-func Name(addr string) string {
-	result, err := net.Trigger(addr, "symbol()", "")
+func Name(ctx context.Context, chain net.ChainProvider, addr string) string {
+	symbol, err := NewERC20(chain, addr).Symbol(ctx)
 	if err != nil {
 		return ""
 	}
-	return string(hexutils.HexToBytes(result)[64:68])
+	return symbol
 }
 
-func Decimals(addr string) uint8 {
-	result, err := net.Trigger(addr, "decimals()", "")
+func Decimals(ctx context.Context, chain net.ChainProvider, addr string) uint8 {
+	decimals, err := NewERC20(chain, addr).Decimals(ctx)
 	if err != nil {
 		return 18
 	}
-	return uint8(misc.ToBigInt(result).Uint64())
+	return decimals
 }
 
-func Balances(addr string, i int) (*big.Int, error) {
-	result, err := net.Trigger(addr, "balances(uint256)", hexutils.BytesToHex(uint256.NewInt(uint64(i)).PaddedBytes(32)))
+func Balances(ctx context.Context, chain net.ChainProvider, addr string, i int) (*big.Int, error) {
+	balance, err := NewCurvePool(chain, addr).Balances(ctx, uint64(i))
 	if err != nil {
 		return big.NewInt(0), err
 	}
-	return misc.ToBigInt(result), nil
+	return balance, nil
 }
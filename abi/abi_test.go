@@ -0,0 +1,181 @@
+package abi
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	ethabi "github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/status-im/keycard-go/hexutils"
+	"psm-monitor/net"
+)
+
+// fakeChain answers trigger calls from a map of selector to hex result
+type fakeChain struct {
+	net.ChainProvider
+	results map[string]string
+	params  map[string]string
+}
+
+func (f *fakeChain) Trigger(_ context.Context, _, selector, param string) (string, error) {
+	f.params[selector] = param
+	return f.results[selector], nil
+}
+
+func pack(t *testing.T, types []string, values ...interface{}) string {
+	var args ethabi.Arguments
+	for _, name := range types {
+		typ, err := ethabi.NewType(name, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, ethabi.Argument{Type: typ})
+	}
+	packed, err := args.Pack(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hexutils.BytesToHex(packed)
+}
+
+func TestERC20(t *testing.T) {
+	const usdt = "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t"
+	chain := &fakeChain{results: map[string]string{
+		"symbol()":           pack(t, []string{"string"}, "USDD Stablecoin"),
+		"decimals()":         pack(t, []string{"uint8"}, uint8(6)),
+		"balanceOf(address)": pack(t, []string{"uint256"}, big.NewInt(123456)),
+	}, params: make(map[string]string)}
+	token := NewERC20(chain, usdt)
+	ctx := context.Background()
+
+	if symbol, err := token.Symbol(ctx); err != nil || symbol != "USDD Stablecoin" {
+		t.Errorf("Symbol() = %q, %v", symbol, err)
+	}
+	if decimals, err := token.Decimals(ctx); err != nil || decimals != 6 {
+		t.Errorf("Decimals() = %d, %v", decimals, err)
+	}
+	if balance, err := token.BalanceOf(ctx, usdt); err != nil || balance.Int64() != 123456 {
+		t.Errorf("BalanceOf() = %v, %v", balance, err)
+	}
+	if want := "000000000000000000000000A614F803B6FD780986A42C78EC9C7F77E6DED13C"; chain.params["balanceOf(address)"] != want {
+		t.Errorf("balanceOf param = %s, want %s", chain.params["balanceOf(address)"], want)
+	}
+}
+
+func TestCurvePoolCoins(t *testing.T) {
+	const usdt = "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t"
+	chain := &fakeChain{results: map[string]string{
+		"coins(uint256)": "000000000000000000000000a614f803b6fd780986a42c78ec9c7f77e6ded13c",
+	}, params: make(map[string]string)}
+	if coin, err := NewCurvePool(chain, "").Coins(context.Background(), 1); err != nil || coin != usdt {
+		t.Errorf("Coins() = %s, %v", coin, err)
+	}
+	if want := pack(t, []string{"uint256"}, big.NewInt(1)); chain.params["coins(uint256)"] != want {
+		t.Errorf("coins param = %s, want %s", chain.params["coins(uint256)"], want)
+	}
+}
+
+func TestMulticall(t *testing.T) {
+	const usdt = "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t"
+	results := []multicallResult{
+		{Success: true, ReturnData: common.FromHex(pack(t, []string{"uint256"}, big.NewInt(42)))},
+		{Success: false},
+	}
+	returnData, err := MustLoad("multicall").Methods["tryBlockAndAggregate"].Outputs.Pack(big.NewInt(100), [32]byte{}, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := &fakeChain{results: map[string]string{
+		"tryBlockAndAggregate(bool,(address,bytes)[])": hexutils.BytesToHex(returnData),
+	}, params: make(map[string]string)}
+
+	multicall := &Multicall{chain: chain, addr: usdt}
+	token := NewERC20(chain, usdt)
+	balance := multicall.Add(token.Contract, "balanceOf", usdt)
+	supply := multicall.Add(token.Contract, "totalSupply")
+	blockNumber, err := multicall.Do(context.Background())
+	if err != nil || blockNumber != 100 {
+		t.Fatalf("Do() = %d, %v", blockNumber, err)
+	}
+	if value, err := balance.BigInt(); err != nil || value.Int64() != 42 {
+		t.Errorf("balanceOf = %v, %v", value, err)
+	}
+	if _, err := supply.BigInt(); !errors.Is(err, ErrCallFailed) {
+		t.Errorf("totalSupply err = %v, want ErrCallFailed", err)
+	}
+
+	// a failed batch fails the later batches too, instead of leaving them without outputs
+	multicall = &Multicall{chain: &fakeChain{results: map[string]string{}, params: make(map[string]string)}, addr: usdt}
+	calls := make([]*Call, maxMulticallBatch+1)
+	for i := range calls {
+		calls[i] = multicall.Add(token.Contract, "totalSupply")
+	}
+	if _, err := multicall.Do(context.Background()); err == nil {
+		t.Fatal("Do() succeeds without a multicall result")
+	}
+	if _, err := calls[maxMulticallBatch].BigInt(); err == nil {
+		t.Error("call of an unsent batch has no error")
+	}
+	if _, err := (&Call{method: "totalSupply"}).BigInt(); err == nil {
+		t.Error("call without outputs has no error")
+	}
+}
+
+func TestDecodeLog(t *testing.T) {
+	addLiquidity := MustLoad("curve_pool").Events["AddLiquidity"]
+	data, err := addLiquidity.Inputs.NonIndexed().Pack(
+		[2]*big.Int{big.NewInt(1000), big.NewInt(2000)}, [2]*big.Int{big.NewInt(1), big.NewInt(2)}, big.NewInt(3), big.NewInt(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, signature, result, ok := DecodeLog(&net.Log{
+		Address: "a614f803b6fd780986a42c78ec9c7f77e6ded13c",
+		Topics: []string{
+			addLiquidity.ID.Hex()[2:],
+			"000000000000000000000000a614f803b6fd780986a42c78ec9c7f77e6ded13c",
+		},
+		Data: hexutils.BytesToHex(data),
+	})
+	if !ok || name != "AddLiquidity" {
+		t.Fatalf("DecodeLog() = %s, %v", name, ok)
+	}
+	if want := "AddLiquidity(address indexed provider, uint256[2] token_amounts, uint256[2] fees, uint256 invariant, uint256 token_supply)"; signature != want {
+		t.Errorf("signature = %s, want %s", signature, want)
+	}
+	event := &net.Event{Result: result}
+	if provider := event.Addr("provider"); provider != "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t" {
+		t.Errorf("provider = %s", provider)
+	}
+	if amounts := event.BigInts("token_amounts"); len(amounts) != 2 || amounts[0].Int64() != 1000 || amounts[1].Int64() != 2000 {
+		t.Errorf("token_amounts = %v", amounts)
+	}
+
+	// overloaded events are decoded under their raw name
+	actionPaused := MustLoad("comptroller").Events["ActionPaused0"]
+	data, err = actionPaused.Inputs.Pack(common.HexToAddress("a614f803b6fd780986a42c78ec9c7f77e6ded13c"), "Borrow", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _, result, ok = DecodeLog(&net.Log{Topics: []string{actionPaused.ID.Hex()[2:]}, Data: hexutils.BytesToHex(data)})
+	event = &net.Event{Result: result}
+	if !ok || name != "ActionPaused" || event.String("action") != "Borrow" || event.String("pauseState") != "true" {
+		t.Errorf("DecodeLog() = %s, %v, %v", name, result, ok)
+	}
+
+	exchangeUnderlying := MustLoad("curve_pool").Events["TokenExchangeUnderlying"]
+	data, err = exchangeUnderlying.Inputs.NonIndexed().Pack(big.NewInt(0), big.NewInt(100), big.NewInt(2), big.NewInt(99))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _, result, ok = DecodeLog(&net.Log{Topics: []string{exchangeUnderlying.ID.Hex()[2:], "000000000000000000000000a614f803b6fd780986a42c78ec9c7f77e6ded13c"}, Data: hexutils.BytesToHex(data)})
+	event = &net.Event{Result: result}
+	if !ok || name != "TokenExchangeUnderlying" || event.BigInt("bought_id").Int64() != 2 {
+		t.Errorf("DecodeLog() = %s, %v, %v", name, result, ok)
+	}
+
+	if _, _, _, ok := DecodeLog(&net.Log{Topics: []string{"00"}}); ok {
+		t.Error("DecodeLog() decodes an unknown event")
+	}
+}
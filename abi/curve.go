@@ -0,0 +1,69 @@
+package abi
+
+import (
+	"context"
+	"math/big"
+
+	"psm-monitor/net"
+)
+
+// CurvePool wraps the constant methods of a Curve style stable swap pool, e.g. the SUN 2pools.
+type CurvePool struct {
+	*Contract
+}
+
+func NewCurvePool(chain net.ChainProvider, addr string) *CurvePool {
+	return &CurvePool{NewContract(chain, addr, MustLoad("curve_pool"))}
+}
+
+func (p *CurvePool) Coins(ctx context.Context, i uint64) (string, error) {
+	return p.CallAddress(ctx, "coins", i)
+}
+
+// UnderlyingCoins returns underlying coin i of a lending pool, the call reverts for other pools
+func (p *CurvePool) UnderlyingCoins(ctx context.Context, i uint64) (string, error) {
+	return p.CallAddress(ctx, "underlying_coins", i)
+}
+
+// BaseCoins returns coin i of the base pool of a metapool, the call reverts for other pools
+func (p *CurvePool) BaseCoins(ctx context.Context, i uint64) (string, error) {
+	return p.CallAddress(ctx, "base_coins", i)
+}
+
+func (p *CurvePool) Balances(ctx context.Context, i uint64) (*big.Int, error) {
+	return p.CallBigInt(ctx, "balances", i)
+}
+
+func (p *CurvePool) A(ctx context.Context) (*big.Int, error) {
+	return p.CallBigInt(ctx, "A")
+}
+
+// GetDy returns how many coin j are received for dx of coin i, both in raw token units
+func (p *CurvePool) GetDy(ctx context.Context, i, j int, dx *big.Int) (*big.Int, error) {
+	return p.CallBigInt(ctx, "get_dy", i, j, dx)
+}
+
+// GetVirtualPrice returns the value of one LP token in the pool coins, scaled by 1e18, it only grows as fees accrue
+func (p *CurvePool) GetVirtualPrice(ctx context.Context) (*big.Int, error) {
+	return p.CallBigInt(ctx, "get_virtual_price")
+}
+
+// Fee returns the swap fee, scaled by 1e10
+func (p *CurvePool) Fee(ctx context.Context) (*big.Int, error) {
+	return p.CallBigInt(ctx, "fee")
+}
+
+// AdminFee returns the share of the swap fee kept by the admin, scaled by 1e10
+func (p *CurvePool) AdminFee(ctx context.Context) (*big.Int, error) {
+	return p.CallBigInt(ctx, "admin_fee")
+}
+
+// AdminBalances returns the admin fees of coin i accrued in the pool, in raw token units
+func (p *CurvePool) AdminBalances(ctx context.Context, i uint64) (*big.Int, error) {
+	return p.CallBigInt(ctx, "admin_balances", i)
+}
+
+// Token returns the LP token of the pool, the call reverts for pools which are their own LP token
+func (p *CurvePool) Token(ctx context.Context) (string, error) {
+	return p.CallAddress(ctx, "token")
+}
@@ -0,0 +1,62 @@
+package abi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"psm-monitor/net"
+)
+
+// ERC20 wraps the constant methods of a TRC20 token.
+type ERC20 struct {
+	*Contract
+}
+
+func NewERC20(chain net.ChainProvider, addr string) *ERC20 {
+	return &ERC20{NewContract(chain, addr, MustLoad("erc20"))}
+}
+
+// Symbol returns the token symbol, tokens returning bytes32 instead of string are supported too
+func (e *ERC20) Symbol(ctx context.Context) (string, error) {
+	outputs, err := e.Call(ctx, "symbol")
+	if output, outputErr := firstOutput("symbol", outputs, err); outputErr == nil {
+		if symbol, ok := output.(string); ok {
+			return symbol, nil
+		}
+	}
+	outputs, bytes32Err := NewContract(e.chain, e.Addr, MustLoad("erc20_bytes32")).Call(ctx, "symbol")
+	output, bytes32Err := firstOutput("symbol", outputs, bytes32Err)
+	if bytes32Err != nil {
+		if err == nil {
+			err = bytes32Err
+		}
+		return "", err
+	}
+	symbol, ok := output.([32]byte)
+	if !ok {
+		return "", fmt.Errorf("abi: symbol returns %T", output)
+	}
+	return string(bytes.TrimRight(symbol[:], "\x00")), nil
+}
+
+func (e *ERC20) Decimals(ctx context.Context) (uint8, error) {
+	outputs, err := e.Call(ctx, "decimals")
+	output, err := firstOutput("decimals", outputs, err)
+	if err != nil {
+		return 0, err
+	}
+	if decimals, ok := output.(uint8); ok {
+		return decimals, nil
+	}
+	return 0, fmt.Errorf("abi: decimals returns %T", output)
+}
+
+func (e *ERC20) TotalSupply(ctx context.Context) (*big.Int, error) {
+	return e.CallBigInt(ctx, "totalSupply")
+}
+
+func (e *ERC20) BalanceOf(ctx context.Context, owner string) (*big.Int, error) {
+	return e.CallBigInt(ctx, "balanceOf", owner)
+}
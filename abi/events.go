@@ -0,0 +1,83 @@
+package abi
+
+import (
+	"strings"
+	"sync"
+
+	ethabi "github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"psm-monitor/net"
+)
+
+// eventABIs are the embedded ABIs whose events DecodeLog knows from the start,
+// curve_pool_N hold the liquidity events of N coin pools, whose signatures differ by their array sizes
+var eventABIs = []string{"erc20", "curve_pool", "curve_pool_3", "curve_pool_4", "psm", "ctoken", "comptroller"}
+
+var (
+	events     map[common.Hash]ethabi.Event
+	eventsLock sync.RWMutex
+	eventsOnce sync.Once
+)
+
+func loadEvents() {
+	eventsOnce.Do(func() {
+		events = make(map[common.Hash]ethabi.Event)
+		for _, name := range eventABIs {
+			registerEvents(MustLoad(name))
+		}
+	})
+}
+
+// RegisterEvents adds the events of an ABI to the ones DecodeLog knows,
+// an event whose signature is already known keeps its first definition.
+func RegisterEvents(contractABI *ethabi.ABI) {
+	loadEvents()
+	registerEvents(contractABI)
+}
+
+func registerEvents(contractABI *ethabi.ABI) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	for _, event := range contractABI.Events {
+		if _, ok := events[event.ID]; !ok && !event.Anonymous {
+			events[event.ID] = event
+		}
+	}
+}
+
+// DecodeLog decodes the topics and data of a raw log with the known event ABIs,
+// integers are returned as *big.Int, integer arrays as []*big.Int and addresses in base58.
+func DecodeLog(log *net.Log) (name, signature string, result map[string]interface{}, ok bool) {
+	if len(log.Topics) == 0 {
+		return "", "", nil, false
+	}
+	loadEvents()
+	eventsLock.RLock()
+	event, ok := events[common.HexToHash(log.Topics[0])]
+	eventsLock.RUnlock()
+	if !ok {
+		return "", "", nil, false
+	}
+
+	result = make(map[string]interface{})
+	if err := event.Inputs.NonIndexed().UnpackIntoMap(result, common.FromHex(log.Data)); err != nil {
+		return "", "", nil, false
+	}
+	var indexed ethabi.Arguments
+	for _, input := range event.Inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+	topics := make([]common.Hash, 0, len(log.Topics)-1)
+	for _, topic := range log.Topics[1:] {
+		topics = append(topics, common.HexToHash(topic))
+	}
+	if err := ethabi.ParseTopicsIntoMap(result, indexed, topics); err != nil {
+		return "", "", nil, false
+	}
+	for key, value := range result {
+		result[key] = FromABIValue(value)
+	}
+	return event.RawName, strings.TrimPrefix(event.String(), "event "), result, true
+}
@@ -0,0 +1,106 @@
+package abi
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"psm-monitor/net"
+)
+
+// JToken wraps the constant methods of a JustLend market, which follows the Compound cToken interface.
+type JToken struct {
+	*Contract
+}
+
+func NewJToken(chain net.ChainProvider, addr string) *JToken {
+	return &JToken{NewContract(chain, addr, MustLoad("ctoken"))}
+}
+
+// Underlying returns the underlying token, the call reverts for the jTRX market whose underlying is TRX
+func (j *JToken) Underlying(ctx context.Context) (string, error) {
+	return j.CallAddress(ctx, "underlying")
+}
+
+// ExchangeRateStored returns how many raw underlying units one raw jToken unit is worth, scaled by 1e18
+func (j *JToken) ExchangeRateStored(ctx context.Context) (*big.Int, error) {
+	return j.CallBigInt(ctx, "exchangeRateStored")
+}
+
+// GetAccountSnapshot returns the jToken balance, the borrow balance in raw underlying units and the exchange rate of account,
+// a non-zero error code of the market is returned as an error
+func (j *JToken) GetAccountSnapshot(ctx context.Context, account string) (balance, borrowBalance, exchangeRate *big.Int, err error) {
+	outputs, err := j.Call(ctx, "getAccountSnapshot", account)
+	values, err := errorCodeOutputs("getAccountSnapshot", outputs, err)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// Comptroller wraps the constant methods of the JustLend unitroller.
+type Comptroller struct {
+	*Contract
+}
+
+func NewComptroller(chain net.ChainProvider, addr string) *Comptroller {
+	return &Comptroller{NewContract(chain, addr, MustLoad("comptroller"))}
+}
+
+func (c *Comptroller) GetAllMarkets(ctx context.Context) ([]string, error) {
+	outputs, err := c.Call(ctx, "getAllMarkets")
+	output, err := firstOutput("getAllMarkets", outputs, err)
+	if err != nil {
+		return nil, err
+	}
+	if markets, ok := output.([]string); ok {
+		return markets, nil
+	}
+	return nil, fmt.Errorf("abi: getAllMarkets returns %T, not addresses", output)
+}
+
+// GetAccountLiquidity returns how much more account may borrow, or how far it is short of its collateral requirement,
+// both in USD scaled by 1e18, only one of them is non-zero
+func (c *Comptroller) GetAccountLiquidity(ctx context.Context, account string) (liquidity, shortfall *big.Int, err error) {
+	outputs, err := c.Call(ctx, "getAccountLiquidity", account)
+	values, err := errorCodeOutputs("getAccountLiquidity", outputs, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return values[0], values[1], nil
+}
+
+func (c *Comptroller) Oracle(ctx context.Context) (string, error) {
+	return c.CallAddress(ctx, "oracle")
+}
+
+// PriceOracle wraps the price oracle of the comptroller.
+type PriceOracle struct {
+	*Contract
+}
+
+func NewPriceOracle(chain net.ChainProvider, addr string) *PriceOracle {
+	return &PriceOracle{NewContract(chain, addr, MustLoad("price_oracle"))}
+}
+
+// GetUnderlyingPrice returns the USD price of one raw unit of the underlying token of the market,
+// scaled by 1e36 as in Compound, so 1e(36-decimals) is one dollar per token
+func (p *PriceOracle) GetUnderlyingPrice(ctx context.Context, jToken string) (*big.Int, error) {
+	return p.CallBigInt(ctx, "getUnderlyingPrice", jToken)
+}
+
+// errorCodeOutputs checks the leading error code returned by the Compound style methods,
+// and returns the remaining integer outputs when it is zero
+func errorCodeOutputs(method string, outputs []interface{}, err error) ([]*big.Int, error) {
+	values, err := bigIntOutputs(method, outputs, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("abi: %s returns no error code", method)
+	}
+	if values[0].Sign() != 0 {
+		return nil, fmt.Errorf("abi: %s fails with error code %s", method, values[0])
+	}
+	return values[1:], nil
+}
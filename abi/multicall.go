@@ -0,0 +1,150 @@
+package abi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	ethabi "github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"psm-monitor/config"
+	"psm-monitor/misc"
+	"psm-monitor/net"
+)
+
+// maxMulticallBatch is the most calls sent in one multicall, more are split across several triggers
+const maxMulticallBatch = 100
+
+var ErrCallFailed = errors.New("abi: call reverted in multicall")
+
+// Call is one read queued in a Multicall, Outputs or Err is set once the Multicall is done.
+type Call struct {
+	Outputs []interface{}
+	Err     error
+
+	contract *Contract
+	method   string
+	args     []interface{}
+}
+
+// BigInt returns the first output of an integer call
+func (c *Call) BigInt() (*big.Int, error) {
+	return bigIntOutput(c.method, c.Outputs, c.Err)
+}
+
+// BigInts returns all outputs of a call returning only integers
+func (c *Call) BigInts() ([]*big.Int, error) {
+	return bigIntOutputs(c.method, c.Outputs, c.Err)
+}
+
+// ErrorCodeOutputs returns the outputs after the leading error code of a Compound style call,
+// a non-zero error code is returned as an error
+func (c *Call) ErrorCodeOutputs() ([]*big.Int, error) {
+	return errorCodeOutputs(c.method, c.Outputs, c.Err)
+}
+
+// Address returns the first output of an address call
+func (c *Call) Address() (string, error) {
+	return addressOutput(c.method, c.Outputs, c.Err)
+}
+
+// Multicall batches constant calls into a single trigger of the Multicall2 contract set by `multicall`,
+// so that all results of a batch are read at the same block. Calls are sent one by one when no contract is configured.
+type Multicall struct {
+	chain net.ChainProvider
+	addr  string
+	calls []*Call
+}
+
+func NewMulticall(chain net.ChainProvider) *Multicall {
+	return &Multicall{chain: chain, addr: config.Get().Multicall}
+}
+
+// Add queues a call of method on contract
+func (m *Multicall) Add(contract *Contract, method string, args ...interface{}) *Call {
+	call := &Call{contract: contract, method: method, args: args}
+	m.calls = append(m.calls, call)
+	return call
+}
+
+// Do sends the queued calls and returns the block number the last batch was read at, 0 when unknown.
+// More than maxMulticallBatch calls are split into batches which may be read at different blocks,
+// so only calls within one batch form a single-block snapshot.
+// A failed call only sets its own Err, the returned error means some calls did not get through
+// and every one of them has Err set.
+func (m *Multicall) Do(ctx context.Context) (uint64, error) {
+	calls := m.calls
+	m.calls = nil
+	if len(m.addr) == 0 {
+		for _, call := range calls {
+			call.Outputs, call.Err = call.contract.Call(ctx, call.method, call.args...)
+		}
+		return 0, nil
+	}
+
+	var blockNumber uint64
+	for len(calls) > 0 {
+		batch := calls
+		if len(batch) > maxMulticallBatch {
+			batch = batch[:maxMulticallBatch]
+		}
+		calls = calls[len(batch):]
+		n, err := m.aggregate(ctx, batch)
+		if err != nil {
+			for _, call := range append(batch, calls...) {
+				call.Err = err
+			}
+			return 0, err
+		}
+		blockNumber = n
+	}
+	return blockNumber, nil
+}
+
+type multicallRequest struct {
+	Target   common.Address
+	CallData []byte
+}
+
+type multicallResult struct {
+	Success    bool   `json:"success"`
+	ReturnData []byte `json:"returnData"`
+}
+
+func (m *Multicall) aggregate(ctx context.Context, calls []*Call) (uint64, error) {
+	requests := make([]multicallRequest, 0, len(calls))
+	sent := make([]*Call, 0, len(calls))
+	for _, call := range calls {
+		callData, err := call.contract.pack(call.method, call.args...)
+		if err != nil {
+			call.Err = err
+			continue
+		}
+		requests = append(requests, multicallRequest{
+			Target:   common.HexToAddress(misc.ToHexAddr(call.contract.Addr)),
+			CallData: callData,
+		})
+		sent = append(sent, call)
+	}
+	if len(requests) == 0 {
+		return 0, nil
+	}
+
+	outputs, err := NewContract(m.chain, m.addr, MustLoad("multicall")).Call(ctx, "tryBlockAndAggregate", false, requests)
+	if err != nil {
+		return 0, err
+	}
+	results := *ethabi.ConvertType(outputs[2], new([]multicallResult)).(*[]multicallResult)
+	if len(results) != len(sent) {
+		return 0, fmt.Errorf("abi: multicall returns %d results for %d calls", len(results), len(sent))
+	}
+	for i, call := range sent {
+		if !results[i].Success {
+			call.Err = fmt.Errorf("%w: %s", ErrCallFailed, call.method)
+			continue
+		}
+		call.Outputs, call.Err = call.contract.unpack(call.method, results[i].ReturnData)
+	}
+	return outputs[0].(*big.Int).Uint64(), nil
+}
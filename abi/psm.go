@@ -0,0 +1,82 @@
+package abi
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"psm-monitor/net"
+)
+
+// PSM wraps the constant methods of a Maker style peg stability module.
+type PSM struct {
+	*Contract
+}
+
+func NewPSM(chain net.ChainProvider, addr string) *PSM {
+	return &PSM{NewContract(chain, addr, MustLoad("psm"))}
+}
+
+// Tin returns the fee of selling gems into the PSM, scaled by 1e18
+func (p *PSM) Tin(ctx context.Context) (*big.Int, error) {
+	return p.CallBigInt(ctx, "tin")
+}
+
+// Tout returns the fee of buying gems from the PSM, scaled by 1e18
+func (p *PSM) Tout(ctx context.Context) (*big.Int, error) {
+	return p.CallBigInt(ctx, "tout")
+}
+
+// Ilk returns the collateral type of the PSM in the vat
+func (p *PSM) Ilk(ctx context.Context) ([32]byte, error) {
+	outputs, err := p.Call(ctx, "ilk")
+	output, err := firstOutput("ilk", outputs, err)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if ilk, ok := output.([32]byte); ok {
+		return ilk, nil
+	}
+	return [32]byte{}, fmt.Errorf("abi: ilk returns %T, not bytes32", output)
+}
+
+func (p *PSM) Vat(ctx context.Context) (string, error) {
+	return p.CallAddress(ctx, "vat")
+}
+
+// Vat wraps the constant methods of the Maker style vault engine.
+type Vat struct {
+	*Contract
+}
+
+func NewVat(chain net.ChainProvider, addr string) *Vat {
+	return &Vat{NewContract(chain, addr, MustLoad("vat"))}
+}
+
+// VatIlk is the debt state of a collateral type, Art is scaled by 1e18, rate and spot by 1e27, line and dust by 1e45
+type VatIlk struct {
+	Art  *big.Int
+	Rate *big.Int
+	Spot *big.Int
+	Line *big.Int
+	Dust *big.Int
+}
+
+// Debt returns the debt of the collateral type, Art accrued by rate, scaled by 1e45 like line
+func (i *VatIlk) Debt() *big.Int {
+	return new(big.Int).Mul(i.Art, i.Rate)
+}
+
+func (v *Vat) Ilks(ctx context.Context, ilk [32]byte) (*VatIlk, error) {
+	outputs, err := v.Call(ctx, "ilks", ilk)
+	values, err := bigIntOutputs("ilks", outputs, err)
+	if err != nil {
+		return nil, err
+	}
+	return NewVatIlk(values), nil
+}
+
+// NewVatIlk builds a VatIlk from the outputs of ilks, e.g. those of a multicall
+func NewVatIlk(values []*big.Int) *VatIlk {
+	return &VatIlk{Art: values[0], Rate: values[1], Spot: values[2], Line: values[3], Dust: values[4]}
+}
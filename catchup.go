@@ -0,0 +1,183 @@
+package main
+
+import (
+	"psm-monitor/config"
+	"psm-monitor/misc"
+	"psm-monitor/net"
+	"psm-monitor/slack"
+
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	defaultCatchUpThreshold = 20
+	defaultCatchUpWorkers   = 4
+
+	catchUpLogInterval   = 10 * time.Second
+	catchUpSlackInterval = 5 * time.Minute
+)
+
+type fetchedBlock struct {
+	block  *net.Block
+	events []*net.Event
+	err    error
+}
+
+type fetchJob struct {
+	blockNumber uint64
+	result      chan *fetchedBlock
+}
+
+func getCatchUpThreshold() uint64 {
+	if threshold := config.Get().Track.CatchUpThreshold; threshold > 0 {
+		return threshold
+	}
+	return defaultCatchUpThreshold
+}
+
+// catchUp fetches blocks up to targetBlockNumber with a bounded worker pool,
+// and hands their events to the handlers strictly in block order.
+// The caller must hold trackLock.
+func catchUp(ctx context.Context, targetBlockNumber uint64) {
+	trackConfig := config.Get().Track
+	workers := trackConfig.CatchUpWorkers
+	if workers <= 0 {
+		workers = defaultCatchUpWorkers
+	}
+	startBlockNumber, startAt := trackedBlockNumber, time.Now()
+	slack.SendMsg(ctx, ":zany_face: [APP]", "Catch-up started, `%d` blocks behind, from `%d` to `%d` with `%d` workers",
+		targetBlockNumber-startBlockNumber, startBlockNumber+1, targetBlockNumber, workers)
+
+	lastLogAt, lastSlackAt := startAt, startAt
+	completed := fetchInOrder(ctx, startBlockNumber+1, targetBlockNumber, workers, trackConfig.CatchUpRate, func(blockNumber uint64, fetched *fetchedBlock) bool {
+		if isTrackStopped() {
+			return false
+		}
+		if fetched.err != nil {
+			misc.Warn("Catch-up task report", fmt.Sprintf("action=\"fetch block %d\" reason=\"%s\"", blockNumber, fetched.err.Error()))
+			slack.SendMsg(ctx, ":zany_face: [APP]", "Catch-up paused at block `%d`, reason `%s`", trackedBlockNumber, fetched.err.Error())
+			return false
+		}
+		if parentHash, ok := trackedHashes[trackedBlockNumber]; ok && parentHash != fetched.block.ParentHash {
+			// let the next tick continue from the common ancestor
+			if err := rewindToCommonAncestor(ctx); err != nil {
+				misc.Warn("Catch-up task report", fmt.Sprintf("action=\"rewind from block %d\" reason=\"%s\"", trackedBlockNumber, err.Error()))
+			}
+			return false
+		}
+		handleEvents(ctx, fetched.events)
+		saveCursor(fetched.block)
+
+		if now := time.Now(); now.Sub(lastLogAt) >= catchUpLogInterval {
+			behind, speed := targetBlockNumber-trackedBlockNumber, blocksPerSecond(trackedBlockNumber-startBlockNumber, now.Sub(startAt))
+			misc.Info("Catch-up task report", fmt.Sprintf("block=%d behind=%d speed=%.2fblk/s", trackedBlockNumber, behind, speed))
+			if now.Sub(lastSlackAt) >= catchUpSlackInterval {
+				slack.SendMsg(ctx, ":zany_face: [APP]", "Catch-up progress, at block `%d`, `%d` blocks behind, `%.2f` blocks/s",
+					trackedBlockNumber, behind, speed)
+				lastSlackAt = now
+			}
+			lastLogAt = now
+		}
+		return true
+	})
+	if !completed {
+		return
+	}
+	cost := time.Now().Sub(startAt)
+	slack.SendMsg(ctx, ":zany_face: [APP]", "Catch-up finished, `%d` blocks in `%s`, `%.2f` blocks/s",
+		trackedBlockNumber-startBlockNumber, cost.Truncate(time.Second), blocksPerSecond(trackedBlockNumber-startBlockNumber, cost))
+}
+
+// fetchInOrder fetches blocks from fromBlockNumber to toBlockNumber with a bounded worker pool,
+// handle is called strictly in block order and stops the fetching by returning false.
+// It reports whether all blocks were handled.
+func fetchInOrder(ctx context.Context, fromBlockNumber, toBlockNumber uint64, workers int, rate float64, handle func(blockNumber uint64, fetched *fetchedBlock) bool) bool {
+	done := make(chan struct{})
+	defer close(done)
+	jobs := make(chan *fetchJob)
+	// pending keeps the fetch results in block order, its capacity bounds how far workers run ahead
+	pending := make(chan *fetchJob, workers*2)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				job.result <- fetchBlock(ctx, job.blockNumber)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		var limiter <-chan time.Time
+		if rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer ticker.Stop()
+			limiter = ticker.C
+		}
+		for number := fromBlockNumber; number <= toBlockNumber; number++ {
+			if limiter != nil {
+				select {
+				case <-limiter:
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+			job := &fetchJob{blockNumber: number, result: make(chan *fetchedBlock, 1)}
+			select {
+			case pending <- job:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for job := range pending {
+		if !handle(job.blockNumber, <-job.result) {
+			return false
+		}
+	}
+	return true
+}
+
+func fetchBlock(ctx context.Context, blockNumber uint64) *fetchedBlock {
+	block, err := chain.GetBlock(ctx, blockNumber)
+	if err != nil {
+		return &fetchedBlock{err: err}
+	}
+	events, err := chain.GetBlockEvents(ctx, blockNumber)
+	if err != nil {
+		return &fetchedBlock{err: err}
+	}
+	return &fetchedBlock{block: block, events: events}
+}
+
+// sortEvents orders events as they were emitted in the block,
+// by the position of their transaction in the block and then by log index.
+func sortEvents(events []*net.Event) []*net.Event {
+	sorted := make([]*net.Event, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].TransactionIndex != sorted[j].TransactionIndex {
+			return sorted[i].TransactionIndex < sorted[j].TransactionIndex
+		}
+		return sorted[i].LogIndex < sorted[j].LogIndex
+	})
+	return sorted
+}
+
+func blocksPerSecond(blocks uint64, cost time.Duration) float64 {
+	if cost <= 0 {
+		return 0
+	}
+	return float64(blocks) / cost.Seconds()
+}
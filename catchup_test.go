@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"psm-monitor/net"
+)
+
+func TestFetchBlockEventOrder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/wallet/getblock":
+			_, _ = w.Write([]byte(`{"blockID":"0064","block_header":{"raw_data":{"number":100,"parentHash":"0063","timestamp":1000}}}`))
+		case "/wallet/gettransactioninfobyblocknum":
+			_, _ = w.Write([]byte(`[{"id":"aa","blockNumber":100},{"id":"bb","blockNumber":100}]`))
+		case "/v1/blocks/100/events":
+			// the event server returns the second transaction of the block first
+			_, _ = w.Write([]byte(`{"success":true,"data":[
+				{"transaction_id":"bb","event_index":0,"event_name":"B0"},
+				{"transaction_id":"bb","event_index":1,"event_name":"B1"},
+				{"transaction_id":"aa","event_index":1,"event_name":"A1"},
+				{"transaction_id":"aa","event_index":0,"event_name":"A0"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	chain = net.NewTronGridProvider(
+		net.NewEndpointPool("full node", []string{server.URL + "/"}, 0, nil),
+		net.NewEndpointPool("event server", []string{server.URL + "/"}, 0, nil))
+	defer func() { chain = nil }()
+
+	fetched := fetchBlock(context.Background(), 100)
+	if fetched.err != nil {
+		t.Fatal(fetched.err)
+	}
+	var names []string
+	for _, event := range sortEvents(fetched.events) {
+		names = append(names, event.EventName)
+	}
+	if got, want := strings.Join(names, ","), "A0,A1,B0,B1"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/BurntSushi/toml"
 )
@@ -12,34 +14,354 @@ type Config struct {
 	LogLevel         string `toml:"log_level"`
 	FullNode         string `toml:"full_node"`
 	EventServer      string `toml:"event_server"`
+	Provider         string `toml:"provider"`
 	ReportFeeAtStart bool   `toml:"report_fee_at_start"`
-	SUN              SUNConfig
-	PSM              PSMConfig
-	JST              JSTConfig
+	// Multicall is the Multicall2 contract batching constant reads, reads are sent one by one when empty
+	Multicall string `toml:"multicall"`
+	// ShutdownTimeout is how many seconds in-flight tasks get to finish on SIGINT/SIGTERM
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+	Net             NetConfig
+	APIKeys         APIKeysConfig
+	Track           TrackConfig
+	SUN             SUNConfig
+	PSM             PSMConfig
+	JST             JSTConfig
+	USDD            USDDConfig
+}
+
+type NetConfig struct {
+	FullNodes    []EndpointConfig `toml:"full_node"`
+	EventServers []EndpointConfig `toml:"event_server"`
+	// EventSource is where events are read from, "event_server" or "full_node" to decode raw transaction logs
+	EventSource string `toml:"event_source"`
+	// MaxBlockLag is how many blocks an endpoint may be behind the others before it is marked down
+	MaxBlockLag uint64 `toml:"max_block_lag"`
+	// NotifyStateChange sends endpoint up/down changes to Slack
+	NotifyStateChange bool `toml:"notify_state_change"`
+}
+
+type EndpointConfig struct {
+	URL string `toml:"url"`
+	// APIKeys are rotated across requests, sent as the TRON-PRO-API-KEY header
+	APIKeys []string `toml:"api_keys"`
+	// RateLimit is the most requests per second sent to this endpoint, 0 means unlimited,
+	// endpoints on the same host share one limit, their keys and their rates and bursts added up
+	RateLimit float64 `toml:"rate_limit"`
+	Burst     int     `toml:"burst"`
+}
+
+// APIKeysConfig holds the keys of the third-party APIs the fee report queries
+type APIKeysConfig struct {
+	Etherscan   string `toml:"etherscan"`
+	BscScan     string `toml:"bscscan"`
+	PolygonScan string `toml:"polygonscan"`
+	Owlracle    string `toml:"owlracle"`
+}
+
+type TrackConfig struct {
+	// MaxBackfill is the most blocks replayed from the stored cursor at startup, 0 means the default
+	MaxBackfill uint64 `toml:"max_backfill"`
+	// Confirmations is how deep a block must be before its events are handled
+	Confirmations uint64 `toml:"confirmations"`
+	// HashHistory is how many handled block hashes are kept for fork detection
+	HashHistory uint64 `toml:"hash_history"`
+	// CatchUpThreshold is how many blocks behind the tracker must be to switch to concurrent catch-up
+	CatchUpThreshold uint64 `toml:"catch_up_threshold"`
+	// CatchUpWorkers is the number of concurrent block fetchers during catch-up
+	CatchUpWorkers int `toml:"catch_up_workers"`
+	// CatchUpRate is the most blocks fetched per second during catch-up, 0 means unlimited
+	CatchUpRate float64 `toml:"catch_up_rate"`
 }
 
 type SUNConfig struct {
 	SwapThreshold      int64 `toml:"swap_threshold"`
 	LiquidityThreshold int64 `toml:"liquidity_threshold"`
 	ReportThreshold    int64 `toml:"report_threshold"`
+	// Quote is the symbol of the coin the other coins of a pool are priced in by the depeg probe
+	Quote string `toml:"quote"`
+	// ProbeSizes are the trade sizes in whole tokens quoted by get_dy, the smallest one prices the coin, no probe when empty
+	ProbeSizes []int64 `toml:"probe_sizes"`
+	// DepegLevels are the deviations from the peg in percent that raise tiered alerts
+	DepegLevels []float64 `toml:"depeg_levels"`
+	// DepegHysteresis is how many percentage points below a level the deviation must fall before the level is cleared
+	DepegHysteresis float64 `toml:"depeg_hysteresis"`
+	// VirtualPriceTolerance is the drop of the virtual price in bps tolerated as rounding, any drop alerts when 0
+	VirtualPriceTolerance float64 `toml:"virtual_price_tolerance"`
+	// Pools are the pools tracked, a change takes effect on restart except the thresholds
+	Pools []PoolConfig `toml:"pool"`
+}
+
+type PoolConfig struct {
+	Name    string `toml:"name"`
+	Address string `toml:"address"`
+	// Coins is the number of coins in the pool, probed on-chain when omitted
+	Coins int `toml:"coins"`
+	// LPToken is the LP token of the pool, read from token() when omitted, or the pool itself when that reverts
+	LPToken string `toml:"lp_token"`
+	// the thresholds fall back to the ones of [SUN] when omitted
+	SwapThreshold      int64 `toml:"swap_threshold"`
+	LiquidityThreshold int64 `toml:"liquidity_threshold"`
+	ReportThreshold    int64 `toml:"report_threshold"`
+	// CoinThresholds override the pool thresholds for the coin with the given symbol
+	CoinThresholds map[string]CoinThresholdConfig `toml:"coin_threshold"`
+}
+
+type CoinThresholdConfig struct {
+	SwapThreshold      int64 `toml:"swap_threshold"`
+	LiquidityThreshold int64 `toml:"liquidity_threshold"`
+	ReportThreshold    int64 `toml:"report_threshold"`
 }
 
 type PSMConfig struct {
 	GemThreshold    int64 `toml:"gem_threshold"`
 	DaiThreshold    int64 `toml:"dai_threshold"`
 	ReportThreshold int64 `toml:"report_threshold"`
+	// UtilizationLevels are the debt ceiling utilizations in percent, an ilk crossing one of them raises an alert
+	UtilizationLevels []float64 `toml:"utilization_levels"`
+	// Ilks are the gems tracked, a change takes effect on restart except the thresholds
+	Ilks []IlkConfig `toml:"ilk"`
+}
+
+type IlkConfig struct {
+	// Symbol and Decimals are resolved on-chain when omitted
+	Symbol   string `toml:"symbol"`
+	Decimals uint8  `toml:"decimals"`
+	Token    string `toml:"token"`
+	GemJoin  string `toml:"gem_join"`
+	PSM      string `toml:"psm"`
+	// GemThreshold and ReportThreshold fall back to the ones of [PSM] when omitted
+	GemThreshold    int64 `toml:"gem_threshold"`
+	ReportThreshold int64 `toml:"report_threshold"`
+}
+
+type USDDConfig struct {
+	// Token is the USDD token, its supply is not monitored when empty
+	Token string `toml:"token"`
+	// MintThreshold and BurnThreshold are the amounts from which a single mint or burn raises an alert
+	MintThreshold int64 `toml:"mint_threshold"`
+	BurnThreshold int64 `toml:"burn_threshold"`
+	// NetChangeThreshold is the net supply change within the last NetChangeWindow seconds that raises an alert
+	NetChangeThreshold int64 `toml:"net_change_threshold"`
+	NetChangeWindow    int64 `toml:"net_change_window"`
 }
 
 type JSTConfig struct {
 	StableThreshold int64 `toml:"stable_threshold"`
 	ReportThreshold int64 `toml:"report_threshold"`
+	// Comptroller is the unitroller, its price oracle values the market operations in USD
+	Comptroller string `toml:"comptroller"`
+	// Discover adds the markets listed by the comptroller`s getAllMarkets() to the configured ones
+	Discover bool `toml:"discover"`
+	// the USD thresholds of market operations, stable_threshold is used when omitted
+	BorrowThreshold int64 `toml:"borrow_threshold"`
+	RedeemThreshold int64 `toml:"redeem_threshold"`
+	MintThreshold   int64 `toml:"mint_threshold"`
+	RepayThreshold  int64 `toml:"repay_threshold"`
+	// LiquidationThreshold is the repaid USD value from which a single liquidation raises an alert, 0 alerts on all
+	LiquidationThreshold int64 `toml:"liquidation_threshold"`
+	// LiquidationVolumeThreshold is the USD value liquidated in the last hour that raises a cascade alert
+	LiquidationVolumeThreshold int64 `toml:"liquidation_volume_threshold"`
+	// UtilizationThreshold is the change of a market utilization in percentage points that raises an alert
+	UtilizationThreshold float64 `toml:"utilization_threshold"`
+	// RateMarkets are the symbols of the markets whose APYs are recorded, reported and watched
+	RateMarkets []string `toml:"rate_markets"`
+	// KinkThreshold is the utilization in percent above which a rate market raises an alert, usually the kink of its rate model
+	KinkThreshold float64 `toml:"kink_threshold"`
+	// APYThreshold is the change of a supply or borrow APY in basis points within an hour that raises an alert
+	APYThreshold float64 `toml:"apy_threshold"`
+	// Markets are the markets tracked, a change takes effect on restart except the thresholds
+	Markets []MarketConfig `toml:"market"`
+	// HealthWarning and HealthCritical are the health margins in percent below which a watched account raises an alert
+	HealthWarning  float64 `toml:"health_warning"`
+	HealthCritical float64 `toml:"health_critical"`
+	// Accounts are the borrowers whose health is watched
+	Accounts []AccountConfig `toml:"account"`
+}
+
+type MarketConfig struct {
+	Address string `toml:"address"`
+	// Symbol and Decimals of the underlying token are resolved on-chain when omitted
+	Symbol   string `toml:"symbol"`
+	Decimals uint8  `toml:"decimals"`
+	// the USD thresholds fall back to the ones of [JST] when omitted
+	BorrowThreshold int64 `toml:"borrow_threshold"`
+	RedeemThreshold int64 `toml:"redeem_threshold"`
+	MintThreshold   int64 `toml:"mint_threshold"`
+	RepayThreshold  int64 `toml:"repay_threshold"`
+	// LiquidationThreshold and Kink fall back to the ones of [JST] when omitted
+	LiquidationThreshold int64   `toml:"liquidation_threshold"`
+	Kink                 float64 `toml:"kink"`
+}
+
+type AccountConfig struct {
+	Name    string `toml:"name"`
+	Address string `toml:"address"`
+}
+
+// FullNodeEndpoints returns the configured full node endpoints, `full_node` is used when no list is given
+func (c *Config) FullNodeEndpoints() []EndpointConfig {
+	return withFallback(c.Net.FullNodes, c.FullNode)
+}
+
+// EventServerEndpoints returns the configured event server endpoints, `event_server` is used when no list is given
+func (c *Config) EventServerEndpoints() []EndpointConfig {
+	return withFallback(c.Net.EventServers, c.EventServer)
+}
+
+// Thresholds returns the thresholds for the coin with the given symbol in the pool at addr,
+// a coin threshold overrides the pool one, which overrides the one of [SUN]
+func (c *SUNConfig) Thresholds(addr, symbol string) CoinThresholdConfig {
+	thresholds := CoinThresholdConfig{
+		SwapThreshold:      c.SwapThreshold,
+		LiquidityThreshold: c.LiquidityThreshold,
+		ReportThreshold:    c.ReportThreshold,
+	}
+	for _, pool := range c.Pools {
+		if pool.Address != addr {
+			continue
+		}
+		thresholds.override(CoinThresholdConfig{
+			SwapThreshold:      pool.SwapThreshold,
+			LiquidityThreshold: pool.LiquidityThreshold,
+			ReportThreshold:    pool.ReportThreshold,
+		})
+		thresholds.override(pool.CoinThresholds[symbol])
+	}
+	return thresholds
+}
+
+func (t *CoinThresholdConfig) override(o CoinThresholdConfig) {
+	if o.SwapThreshold != 0 {
+		t.SwapThreshold = o.SwapThreshold
+	}
+	if o.LiquidityThreshold != 0 {
+		t.LiquidityThreshold = o.LiquidityThreshold
+	}
+	if o.ReportThreshold != 0 {
+		t.ReportThreshold = o.ReportThreshold
+	}
+}
+
+// Market returns the config of the market at addr, with the [JST] thresholds filled in
+func (c *JSTConfig) Market(addr string) MarketConfig {
+	market := MarketConfig{Address: addr}
+	for _, candidate := range c.Markets {
+		if candidate.Address == addr {
+			market = candidate
+		}
+	}
+	fallback := func(threshold *int64, defaults ...int64) {
+		for _, d := range defaults {
+			if *threshold == 0 {
+				*threshold = d
+			}
+		}
+	}
+	fallback(&market.BorrowThreshold, c.BorrowThreshold, c.StableThreshold)
+	fallback(&market.RedeemThreshold, c.RedeemThreshold, c.StableThreshold)
+	fallback(&market.MintThreshold, c.MintThreshold, c.StableThreshold)
+	fallback(&market.RepayThreshold, c.RepayThreshold, c.StableThreshold)
+	fallback(&market.LiquidationThreshold, c.LiquidationThreshold)
+	if market.Kink == 0 {
+		market.Kink = c.KinkThreshold
+	}
+	return market
+}
+
+// TracksRate tells whether the APYs of the market with the given underlying symbol are tracked
+func (c *JSTConfig) TracksRate(symbol string) bool {
+	for _, candidate := range c.RateMarkets {
+		if candidate == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+// Account returns the config of the watched account at addr
+func (c *JSTConfig) Account(addr string) (AccountConfig, bool) {
+	for _, account := range c.Accounts {
+		if account.Address == addr {
+			return account, true
+		}
+	}
+	return AccountConfig{}, false
+}
+
+// Ilk returns the config of the ilk whose gem is token, with the [PSM] thresholds filled in
+func (c *PSMConfig) Ilk(token string) IlkConfig {
+	ilk := IlkConfig{Token: token}
+	for _, candidate := range c.Ilks {
+		if candidate.Token == token {
+			ilk = candidate
+		}
+	}
+	if ilk.GemThreshold == 0 {
+		ilk.GemThreshold = c.GemThreshold
+	}
+	if ilk.ReportThreshold == 0 {
+		ilk.ReportThreshold = c.ReportThreshold
+	}
+	return ilk
 }
 
+func withFallback(endpoints []EndpointConfig, fallback string) []EndpointConfig {
+	if len(endpoints) == 0 {
+		return []EndpointConfig{{URL: fallback}}
+	}
+	return endpoints
+}
+
+const DefaultPath = "./config.toml"
+
+var (
+	current  atomic.Pointer[Config]
+	path     = DefaultPath
+	loadLock sync.Mutex
+)
+
+// Load reads and validates the config file at p, it is cached and returned by Get from then on.
+func Load(p string) error {
+	loadLock.Lock()
+	defer loadLock.Unlock()
+	config, err := parse(p)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("config: %s: %w", p, err)
+	}
+	path = p
+	current.Store(config)
+	return nil
+}
+
+// Get returns the cached config, the default path is loaded without validation when Load was never called
 func Get() *Config {
-	var config Config
-	data, err := toml.DecodeFile("./config.toml", &config)
+	if config := current.Load(); config != nil {
+		return config
+	}
+	loadLock.Lock()
+	defer loadLock.Unlock()
+	if config := current.Load(); config != nil {
+		return config
+	}
+	config, err := parse(path)
 	if err != nil {
-		fmt.Println(data, err)
+		fmt.Println(err)
+	}
+	current.Store(config)
+	return config
+}
+
+// parse decodes the config file at p and applies the environment overrides on top of it
+func parse(p string) (*Config, error) {
+	var config Config
+	if _, err := toml.DecodeFile(p, &config); err != nil {
+		return &config, fmt.Errorf("config: %w", err)
+	}
+	if err := applyEnv(&config); err != nil {
+		return &config, fmt.Errorf("config: %w", err)
 	}
-	return &config
+	return &config, nil
 }
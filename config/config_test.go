@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func validConfig() *Config {
+	return &Config{
+		SlackWebhook:    "https://hooks.slack.com/services/a",
+		FeeSlackWebhook: "https://hooks.slack.com/services/b",
+		FullNode:        "https://api.trongrid.io/",
+		EventServer:     "https://api.trongrid.io/",
+		SUN:             SUNConfig{SwapThreshold: 1, LiquidityThreshold: 1, ReportThreshold: 1},
+		PSM:             PSMConfig{GemThreshold: 1, DaiThreshold: 1, ReportThreshold: 1},
+		JST:             JSTConfig{StableThreshold: 1, ReportThreshold: 1},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	c := validConfig()
+	c.SlackWebhook = "...(your slack webhook url)"
+	c.Net.FullNodes = []EndpointConfig{{URL: "https://api.trongrid.io"}}
+	c.PSM.GemThreshold = 0
+	c.Track.MaxBackfill, c.Track.CatchUpThreshold = 10, 20
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Validate() accepts an invalid config")
+	}
+	for _, want := range []string{"slack_webhook", "full_node", "PSM.gem_threshold", "Track.max_backfill"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %s", err, want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "webhook")
+	if err := os.WriteFile(secret, []byte("https://hooks.slack.com/services/secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PSM_MONITOR_SLACK_WEBHOOK_FILE", secret)
+	t.Setenv("PSM_MONITOR_SUN_SWAP_THRESHOLD", "1_000_000")
+	t.Setenv("PSM_MONITOR_APIKEYS_ETHERSCAN", "key")
+	t.Setenv("PSM_MONITOR_NET_NOTIFY_STATE_CHANGE", "true")
+	t.Setenv("PSM_MONITOR_NET_FULL_NODE_1_API_KEYS", "key1, key2")
+
+	c := validConfig()
+	c.Net.FullNodes = []EndpointConfig{{URL: "https://a.trongrid.io/"}, {URL: "https://b.trongrid.io/"}}
+	if err := applyEnv(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.SlackWebhook != "https://hooks.slack.com/services/secret" || c.SUN.SwapThreshold != 1_000_000 ||
+		c.APIKeys.Etherscan != "key" || !c.Net.NotifyStateChange ||
+		len(c.Net.FullNodes[0].APIKeys) != 0 || strings.Join(c.Net.FullNodes[1].APIKeys, ",") != "key1,key2" {
+		t.Errorf("applyEnv() = %+v", c)
+	}
+
+	t.Setenv("PSM_MONITOR_TRACK_CONFIRMATIONS", "many")
+	if err := applyEnv(c); err == nil {
+		t.Error("applyEnv() accepts an invalid integer")
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variables overriding config items
+const EnvPrefix = "PSM_MONITOR_"
+
+// applyEnv overrides config items with environment variables named by their toml path,
+// e.g. PSM_MONITOR_SLACK_WEBHOOK for `slack_webhook` or PSM_MONITOR_SUN_SWAP_THRESHOLD for `[SUN] swap_threshold`.
+// PSM_MONITOR_<NAME>_FILE names a file the value is read from instead, e.g. a docker or k8s secret mount.
+// Lists of plain values are comma separated. Lists of tables like the endpoints can not be replaced,
+// but the items in the file are overridden by their index, e.g. PSM_MONITOR_NET_FULL_NODE_0_API_KEYS.
+func applyEnv(config *Config) error {
+	return applyEnvTo(reflect.ValueOf(config).Elem(), EnvPrefix)
+}
+
+func applyEnvTo(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		name := field.Tag.Get("toml")
+		if len(name) == 0 {
+			name = field.Name
+		}
+		name = prefix + strings.ToUpper(name)
+		if value.Kind() == reflect.Struct {
+			if err := applyEnvTo(value, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < value.Len(); j++ {
+				if err := applyEnvTo(value.Index(j), fmt.Sprintf("%s_%d_", name, j)); err != nil {
+					return err
+				}
+			}
+		}
+		env, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(value, env); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the value of the variable, or the trimmed content of the file named by <name>_FILE
+func lookupEnv(name string) (string, bool, error) {
+	if file, ok := os.LookupEnv(name + "_FILE"); ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		return strings.TrimSpace(string(data)), true, nil
+	}
+	value, ok := os.LookupEnv(name)
+	return value, ok, nil
+}
+
+func setValue(value reflect.Value, env string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(env)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.ReplaceAll(env, "_", ""), 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(strings.ReplaceAll(env, "_", ""), 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		if kind := value.Type().Elem().Kind(); kind == reflect.Slice || kind == reflect.Struct {
+			return fmt.Errorf("%s can not be set from the environment", value.Type())
+		}
+		items := reflect.MakeSlice(value.Type(), 0, 0)
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); len(item) == 0 {
+				continue
+			}
+			elem := reflect.New(value.Type().Elem()).Elem()
+			if err := setValue(elem, item); err != nil {
+				return err
+			}
+			items = reflect.Append(items, elem)
+		}
+		value.Set(items)
+	default:
+		return fmt.Errorf("%s can not be set from the environment", value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Validate checks that the webhooks and endpoints are well formed urls
+// and that every threshold is positive, all problems are reported at once.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(isURL(c.SlackWebhook), "slack_webhook %q is not a http(s) url", c.SlackWebhook)
+	check(isURL(c.FeeSlackWebhook), "fee_slack_webhook %q is not a http(s) url", c.FeeSlackWebhook)
+	check(oneOf(strings.ToUpper(c.LogLevel), "", "DEBUG", "INFO", "WARN", "ERROR"), "log_level %q is unknown", c.LogLevel)
+	check(oneOf(c.Provider, "", "trongrid", "jsonrpc"), "provider %q is unknown", c.Provider)
+	check(oneOf(c.Net.EventSource, "", "event_server", "full_node"), "Net.event_source %q is unknown", c.Net.EventSource)
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+
+	endpoints := map[string][]EndpointConfig{"full_node": c.FullNodeEndpoints()}
+	if c.Provider != "jsonrpc" && c.Net.EventSource != "full_node" {
+		endpoints["event_server"] = c.EventServerEndpoints()
+	}
+	for role, list := range endpoints {
+		for _, endpoint := range list {
+			// paths are appended to the url as is
+			check(isURL(endpoint.URL) && strings.HasSuffix(endpoint.URL, "/"), "%s %q is not a http(s) url ending with /", role, endpoint.URL)
+			check(endpoint.RateLimit >= 0 && endpoint.Burst >= 0, "%s %q rate_limit and burst must not be negative", role, endpoint.URL)
+		}
+	}
+
+	// a restart should replay at least as many blocks as a running tracker catches up without skipping
+	check(c.Track.MaxBackfill == 0 || c.Track.MaxBackfill >= c.Track.CatchUpThreshold, "Track.max_backfill must not be below catch_up_threshold")
+	check(c.Track.CatchUpWorkers >= 0 && c.Track.CatchUpRate >= 0, "Track.catch_up_workers and catch_up_rate must not be negative")
+
+	check(c.SUN.SwapThreshold > 0, "SUN.swap_threshold must be positive")
+	check(c.SUN.LiquidityThreshold > 0, "SUN.liquidity_threshold must be positive")
+	check(c.SUN.ReportThreshold > 0, "SUN.report_threshold must be positive")
+	for i, pool := range c.SUN.Pools {
+		check(len(pool.Address) != 0, "SUN.pool[%d] needs address", i)
+		check(pool.Coins >= 0, "SUN.pool[%d] coins must not be negative", i)
+		check(pool.SwapThreshold >= 0 && pool.LiquidityThreshold >= 0 && pool.ReportThreshold >= 0, "SUN.pool[%d] thresholds must not be negative", i)
+		for symbol, coin := range pool.CoinThresholds {
+			check(coin.SwapThreshold >= 0 && coin.LiquidityThreshold >= 0 && coin.ReportThreshold >= 0, "SUN.pool[%d] %s thresholds must not be negative", i, symbol)
+		}
+	}
+	for i, size := range c.SUN.ProbeSizes {
+		check(size > 0 && (i == 0 || size > c.SUN.ProbeSizes[i-1]), "SUN.probe_sizes must be positive and ascending")
+	}
+	for i, level := range c.SUN.DepegLevels {
+		check(level > 0 && (i == 0 || level > c.SUN.DepegLevels[i-1]), "SUN.depeg_levels must be positive and ascending")
+	}
+	check(c.SUN.DepegHysteresis >= 0, "SUN.depeg_hysteresis must not be negative")
+	check(c.SUN.VirtualPriceTolerance >= 0, "SUN.virtual_price_tolerance must not be negative")
+	check(len(c.SUN.ProbeSizes) == 0 || len(c.SUN.Quote) != 0, "SUN.probe_sizes needs quote")
+	check(c.PSM.GemThreshold > 0, "PSM.gem_threshold must be positive")
+	check(c.PSM.DaiThreshold > 0, "PSM.dai_threshold must be positive")
+	check(c.PSM.ReportThreshold > 0, "PSM.report_threshold must be positive")
+	for i, level := range c.PSM.UtilizationLevels {
+		check(level > 0 && (i == 0 || level > c.PSM.UtilizationLevels[i-1]), "PSM.utilization_levels must be positive and ascending")
+	}
+	for i, ilk := range c.PSM.Ilks {
+		check(len(ilk.Token) != 0 && len(ilk.GemJoin) != 0 && len(ilk.PSM) != 0, "PSM.ilk[%d] needs token, gem_join and psm", i)
+		check(ilk.GemThreshold >= 0 && ilk.ReportThreshold >= 0, "PSM.ilk[%d] thresholds must not be negative", i)
+	}
+	check(c.JST.StableThreshold > 0, "JST.stable_threshold must be positive")
+	check(c.JST.ReportThreshold > 0, "JST.report_threshold must be positive")
+	check(c.JST.LiquidationThreshold >= 0 && c.JST.LiquidationVolumeThreshold >= 0, "JST liquidation thresholds must not be negative")
+	check(c.JST.UtilizationThreshold >= 0, "JST.utilization_threshold must not be negative")
+	check(c.JST.KinkThreshold >= 0 && c.JST.KinkThreshold <= 100, "JST.kink_threshold must be within 0 ~ 100")
+	check(c.JST.APYThreshold >= 0, "JST.apy_threshold must not be negative")
+	check(!c.JST.Discover || len(c.JST.Comptroller) != 0, "JST.discover needs comptroller")
+	check(c.JST.BorrowThreshold >= 0 && c.JST.RedeemThreshold >= 0 && c.JST.MintThreshold >= 0 && c.JST.RepayThreshold >= 0, "JST thresholds must not be negative")
+	check(c.JST.HealthCritical >= 0 && c.JST.HealthCritical <= c.JST.HealthWarning && c.JST.HealthWarning <= 100,
+		"JST health levels must satisfy 0 <= health_critical <= health_warning <= 100")
+	for i, account := range c.JST.Accounts {
+		check(len(account.Address) != 0, "JST.account[%d] needs address", i)
+	}
+	for i, market := range c.JST.Markets {
+		check(len(market.Address) != 0, "JST.market[%d] needs address", i)
+		check(market.BorrowThreshold >= 0 && market.RedeemThreshold >= 0 && market.MintThreshold >= 0 && market.RepayThreshold >= 0 && market.LiquidationThreshold >= 0, "JST.market[%d] thresholds must not be negative", i)
+		check(market.Kink >= 0 && market.Kink <= 100, "JST.market[%d].kink must be within 0 ~ 100", i)
+	}
+	if len(c.USDD.Token) != 0 {
+		check(c.USDD.MintThreshold > 0 && c.USDD.BurnThreshold > 0 && c.USDD.NetChangeThreshold > 0, "USDD thresholds must be positive")
+		check(c.USDD.NetChangeWindow > 0, "USDD.net_change_window must be positive")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) != 0
+}
+
+func oneOf(s string, options ...string) bool {
+	for _, option := range options {
+		if s == option {
+			return true
+		}
+	}
+	return false
+}
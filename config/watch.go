@@ -0,0 +1,43 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls the loaded config file every interval until ctx is done. A valid edit is swapped in
+// atomically and passed to onChange, an invalid one is rejected and its error passed to onReject,
+// the previous config stays in use then. Endpoints and provider only take effect on restart.
+func Watch(ctx context.Context, interval time.Duration, onChange func(*Config), onReject func(error)) {
+	loadLock.Lock()
+	p := path
+	loadLock.Unlock()
+	last, _ := os.ReadFile(p)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(p)
+		// the file may be missing for a moment while an editor replaces it
+		if err != nil || bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		if err := Load(p); err != nil {
+			if onReject != nil {
+				onReject(err)
+			}
+			continue
+		}
+		if onChange != nil {
+			onChange(Get())
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"sync"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const defaultPath = "monitor.db"
+
+var (
+	appDB  *gorm.DB
+	openDB sync.Once
+)
+
+// Get returns the shared SQLite handle, opening monitor.db on first use.
+func Get() *gorm.DB {
+	openDB.Do(func() {
+		db, err := gorm.Open(sqlite.Open(defaultPath), &gorm.Config{})
+		if err != nil {
+			panic("failed to connect database")
+		}
+		appDB = db
+	})
+	return appDB
+}
@@ -9,15 +9,15 @@ require (
 	github.com/holiman/uint256 v1.2.0
 	github.com/robfig/cron v1.2.0
 	github.com/status-im/keycard-go v0.0.0-20220804094519-059bc140cef1
+	github.com/thedevsaddam/gojsonq/v2 v2.5.2
+	gorm.io/driver/sqlite v1.5.2
+	gorm.io/gorm v1.25.2
 )
 
 require (
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/mattn/go-sqlite3 v1.14.17 // indirect
-	github.com/thedevsaddam/gojsonq/v2 v2.5.2 // indirect
 	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
 	golang.org/x/sys v0.0.0-20220808155132-1c4a2a72c664 // indirect
-	gorm.io/driver/sqlite v1.5.2 // indirect
-	gorm.io/gorm v1.25.2 // indirect
 )
@@ -1,79 +1,141 @@
 package main
 
 import (
+	"psm-monitor/abi"
 	"psm-monitor/config"
 	"psm-monitor/misc"
 	"psm-monitor/monitor"
 	"psm-monitor/net"
 	"psm-monitor/slack"
 
+	"context"
+	"flag"
 	"fmt"
 	"math/rand"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/robfig/cron"
 )
 
-var (
-	trackedBlockNumber uint64
-	trackedEvent       map[string]func(event *net.Event)
-	trackLock          sync.RWMutex
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	shutdownNoticeTimeout  = 5 * time.Second
+	configWatchInterval    = 5 * time.Second
 )
 
+// usage: psm-monitor [--config file] [replay ...]
 func main() {
-	initApp()
+	configPath := flag.String("config", config.DefaultPath, "config file, watched for changes while running")
+	flag.Parse()
+	if err := config.Load(*configPath); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "replay" {
+		rand.Seed(time.Now().UnixNano())
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := runReplay(ctx, args[1:]); err != nil {
+			fmt.Println("replay failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// ctx is only canceled when the shutdown deadline is exceeded, in-flight work keeps running until then
+	ctx, cancel := context.WithCancel(context.Background())
+	initApp(ctx)
 
 	c := cron.New()
-	monitor.StartPSM(c, trackedEvent)
-	monitor.StartSUN(c, trackedEvent)
-	monitor.StartJST(c, trackedEvent)
-	monitor.StartTrackFee(c)
-	_ = c.AddFunc("*/3 * * * * ?", misc.WrapLog(track))
+	monitor.StartPSM(ctx, c, chain, trackedEvent)
+	monitor.StartSUN(ctx, c, chain, trackedEvent)
+	monitor.StartJST(ctx, c, chain, trackedEvent)
+	monitor.StartUSDD(ctx, c, chain, trackedEvent)
+	monitor.StartTrackFee(ctx, c)
+	_ = c.AddFunc("*/3 * * * * ?", misc.WrapLog(ctx, track))
+	if checker, ok := chain.(net.HealthChecker); ok {
+		_ = c.AddFunc("*/30 * * * * ?", misc.WrapLog(ctx, checker.CheckHealth))
+	}
 	c.Start()
+	go config.Watch(ctx, configWatchInterval, onConfigChange, onConfigReject)
 
 	if config.Get().ReportFeeAtStart {
-		monitor.ReportFee()
+		monitor.ReportFee(ctx)
 	}
 
-	defer c.Stop()
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	shutdown(c, cancel, <-signals)
 }
 
-func initApp() {
-	slack.SendMsg(":zany_face: [APP]", "Monitor now started, components - [PSM, SUN, JST]")
-	trackedBlockNumber = net.BlockNumber()
-	trackedEvent = make(map[string]func(event *net.Event))
+func initApp(ctx context.Context) {
+	slack.SendMsg(ctx, ":zany_face: [APP]", "Monitor now started, components - [PSM, SUN, JST, USDD]")
+	if len(config.Get().Multicall) == 0 {
+		misc.Warn("Startup report", "action=\"batch constant reads\" reason=\"multicall is not set\"")
+		slack.SendMsg(ctx, ":zany_face: [APP]", ":warning: `multicall` is not set, constant reads are sent one by one and snapshots are not read at a single block")
+	}
+	net.SetLogDecoder(abi.DecodeLog)
+	chain = net.NewChainProvider(notifyEndpointState)
+	trackedEvent = make(map[string]func(ctx context.Context, event *net.Event))
 	rand.Seed(time.Now().UnixNano())
+	initTracker(ctx)
 }
 
-func track() {
-	trackLock.Lock()
-	defer trackLock.Unlock()
-	latestBlockEvents := net.GetLatestBlockEvents()
-	if len(latestBlockEvents) > 0 {
-		latestBlockNumber := latestBlockEvents[0].BlockNumber
-		if trackedBlockNumber >= latestBlockNumber {
-			// current block has already been tracked
-			misc.Info("Track task report", fmt.Sprintf("block %d is already tracked", trackedBlockNumber))
-		} else {
-			for trackedBlockNumber < latestBlockNumber-1 {
-				trackedBlockNumber += 1
-				events := net.GetBlockEvents(trackedBlockNumber)
-				handleEvents(events)
-				misc.Info("Track task report", fmt.Sprintf("block %d is missed, has %d events", trackedBlockNumber, len(events)))
-			}
-			handleEvents(latestBlockEvents)
-			trackedBlockNumber = latestBlockNumber
-			misc.Info("Track task report", fmt.Sprintf("block %d is latest, has %d events", trackedBlockNumber, len(latestBlockEvents)))
+// shutdown stops scheduling new tasks, lets the tasks, handlers and endpoint notifications
+// in flight finish within the configured deadline, then cancels whatever is left and posts a notice.
+func shutdown(c *cron.Cron, cancel context.CancelFunc, sig os.Signal) {
+	misc.Info("Shutdown report", fmt.Sprintf("received %s, stopping", sig))
+	c.Stop()
+
+	timeout := defaultShutdownTimeout
+	if seconds := config.Get().ShutdownTimeout; seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), timeout)
+	defer cancelDeadline()
+
+	drained := make(chan struct{})
+	go func() {
+		misc.WaitTasks()
+		net.WaitNotifications()
+		close(drained)
+	}()
+	graceful := stopTracker(deadline)
+	if graceful {
+		select {
+		case <-drained:
+		case <-deadline.Done():
+			graceful = false
 		}
 	}
+	cancel()
+
+	status := "all tasks finished"
+	if !graceful {
+		status = fmt.Sprintf("tasks still running after `%s` were canceled", timeout)
+		misc.Warn("Shutdown report", status)
+	}
+	noticeCtx, cancelNotice := context.WithTimeout(context.Background(), shutdownNoticeTimeout)
+	defer cancelNotice()
+	slack.SendMsg(noticeCtx, ":zany_face: [APP]", "Monitor now stopped on `%s`, %s, tracked block `%d`", sig, status, trackedBlockNumber)
 }
 
-func handleEvents(events []*net.Event) {
-	for _, event := range events {
-		if f, ok := trackedEvent[event.Address]; ok {
-			f(event)
-		}
+func notifyEndpointState(content string) {
+	if config.Get().Net.NotifyStateChange {
+		slack.SendMsg(context.Background(), ":zany_face: [APP]", content)
 	}
 }
+
+func onConfigChange(_ *config.Config) {
+	misc.Info("Config report", "action=\"reload config\" status=success")
+	slack.SendMsg(context.Background(), ":zany_face: [APP]", "Config reloaded")
+}
+
+func onConfigReject(err error) {
+	misc.Warn("Config report", fmt.Sprintf("action=\"reload config\" reason=\"%s\"", err.Error()))
+	slack.SendMsg(context.Background(), ":zany_face: [APP]", "Config change rejected, keep running with the previous one, reason - `%s`", err.Error())
+}
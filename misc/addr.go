@@ -14,3 +14,9 @@ func ToEthAddr(tronAddr string) string {
 func ToTronAddr(ethAddr string) string {
 	return base58.CheckEncode(common.BytesToAddress(common.FromHex(ethAddr)).Bytes(), 0x41)
 }
+
+// ToHexAddr converts a base58 tron address to its 20 bytes 0x-prefixed hex form
+func ToHexAddr(tronAddr string) string {
+	ethAddr, _, _ := base58.CheckDecode(tronAddr)
+	return common.BytesToAddress(ethAddr).Hex()
+}
@@ -1,6 +1,7 @@
 package misc
 
 import (
+	"context"
 	"psm-monitor/config"
 
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,7 +26,12 @@ func GetTokenLogo(token string) string {
 }
 
 func FormatTokenAmt(token string, amt *big.Int, isDiff bool) string {
-	text := fmt.Sprintf("%s - `%s`", GetTokenLogo(token), ToReadableDec(big.NewInt(0).Abs(amt)))
+	logo := GetTokenLogo(token)
+	if len(logo) == 0 {
+		// tokens without a logo emoji are shown by their symbol
+		logo = token
+	}
+	text := fmt.Sprintf("%s - `%s`", logo, ToReadableDec(big.NewInt(0).Abs(amt)))
 	if isDiff {
 		if amt.Sign() > 0 {
 			text += " :arrow_heading_up:"
@@ -37,6 +44,10 @@ func FormatTokenAmt(token string, amt *big.Int, isDiff bool) string {
 	return text
 }
 
+func FormatUSD(amt *big.Int) string {
+	return fmt.Sprintf(":dollar: - `$%s`", ToReadableDec(big.NewInt(0).Abs(amt)))
+}
+
 func FormatUser(addr string) string {
 	if !strings.HasPrefix(addr, "T") {
 		addr = ToTronAddr(addr)
@@ -48,15 +59,25 @@ func FormatTxUrl(txHash string) string {
 	return fmt.Sprintf(":clippy:<https://tronscan.io/#/transaction/%s|TxHash>", txHash)
 }
 
-func WrapLog(f func()) func() {
+// runningTasks counts the scheduled tasks in flight, so shutdown can wait for them
+var runningTasks sync.WaitGroup
+
+func WrapLog(ctx context.Context, f func(ctx context.Context)) func() {
 	return func() {
+		runningTasks.Add(1)
+		defer runningTasks.Done()
 		startAt := time.Now()
-		f()
+		f(ctx)
 		costMilli := time.Now().Sub(startAt).Milliseconds()
 		Info("Scheduled task report", fmt.Sprintf("task=[%s] cost=%dms", getFunctionName(f, '/'), costMilli))
 	}
 }
 
+// WaitTasks blocks until all scheduled tasks in flight returned
+func WaitTasks() {
+	runningTasks.Wait()
+}
+
 type logLevel struct {
 	levelMap map[string]uint8
 }
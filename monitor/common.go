@@ -0,0 +1,39 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"psm-monitor/misc"
+	"psm-monitor/net"
+)
+
+// getTxFrom returns the owner address of the transaction, empty if it cannot be queried
+func getTxFrom(ctx context.Context, chain net.ChainProvider, id string) string {
+	tx, err := chain.GetTransaction(ctx, id)
+	if err != nil {
+		misc.Warn("getTxFrom", fmt.Sprintf("action=\"query tx %s\" reason=\"%s\"", id, err.Error()))
+		return ""
+	}
+	return tx.From
+}
+
+// subscribe adds handler to the ones called for the events of addr, earlier handlers are called first
+func subscribe(concerned map[string]func(ctx context.Context, event *net.Event), addr string, handler func(ctx context.Context, event *net.Event)) {
+	prev, ok := concerned[addr]
+	if !ok {
+		concerned[addr] = handler
+		return
+	}
+	concerned[addr] = func(ctx context.Context, event *net.Event) {
+		prev(ctx, event)
+		handler(ctx, event)
+	}
+}
+
+// formatMantissa formats a factor scaled by 1e18 as a percentage
+func formatMantissa(mantissa *big.Int) string {
+	percent, _ := new(big.Rat).SetFrac(mantissa, misc.GetDec(16)).Float64()
+	return fmt.Sprintf("`%.2f%%`", percent)
+}
@@ -1,12 +1,13 @@
 package monitor
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/robfig/cron"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"psm-monitor/db"
 	"psm-monitor/misc"
 	"psm-monitor/net"
 	"psm-monitor/slack"
@@ -31,40 +32,35 @@ type Record struct {
 
 var appDB *gorm.DB
 
-func StartTrackFee(c *cron.Cron) {
-	_ = c.AddFunc("0 */1 * * * ?", misc.WrapLog(track))
-	_ = c.AddFunc("30 0 2 * * ?", misc.WrapLog(report))
+func StartTrackFee(ctx context.Context, c *cron.Cron) {
+	_ = c.AddFunc("0 */1 * * * ?", misc.WrapLog(ctx, track))
+	_ = c.AddFunc("30 0 2 * * ?", misc.WrapLog(ctx, report))
 
-	db, err := gorm.Open(sqlite.Open("monitor.db"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
-	}
-	db.AutoMigrate(&Record{})
-
-	appDB = db
+	appDB = db.Get()
+	appDB.AutoMigrate(&Record{})
 }
 
-func ReportFee() {
-	report()
+func ReportFee(ctx context.Context) {
+	report(ctx)
 }
 
-func track() {
-	trxPrice := net.GetPrice("TRX")
-	energyPrice, factor := net.GetEnergyPriceAndFactor()
+func track(ctx context.Context) {
+	trxPrice := net.GetPrice(ctx, "TRX")
+	energyPrice, factor := net.GetEnergyPriceAndFactor(ctx)
 
-	ethPrice := net.GetPrice("ETH")
-	ethGasPrice := net.GetGasPrice("Ethereum")
+	ethPrice := net.GetPrice(ctx, "ETH")
+	ethGasPrice := net.GetGasPrice(ctx, "Ethereum")
 
-	bnbPrice := net.GetPrice("BNB")
-	bscGasPrice := net.GetGasPrice("BSC")
+	bnbPrice := net.GetPrice(ctx, "BNB")
+	bscGasPrice := net.GetGasPrice(ctx, "BSC")
 
-	polPrice := net.GetPrice("POL")
-	polGasPrice := net.GetGasPrice("Polygon")
+	polPrice := net.GetPrice(ctx, "POL")
+	polGasPrice := net.GetGasPrice(ctx, "Polygon")
 
-	avaxPrice := net.GetPrice("AVAX")
-	avaxGasPrice := net.GetAvalanchePrice()
+	avaxPrice := net.GetPrice(ctx, "AVAX")
+	avaxGasPrice := net.GetAvalanchePrice(ctx)
 
-	solPrice := net.GetSolPrice()
+	solPrice := net.GetSolPrice(ctx)
 
 	tronLowPrice := trxPrice * energyPrice * (1 + factor/1e4) * 14650 / 1e6
 	tronHighPrice := trxPrice * energyPrice * (1 + factor/1e4) * 29650 / 1e6
@@ -93,7 +89,7 @@ func track() {
 		SolanaLowPrice: solanaLowPrice, SolanaHighPrice: solanaHighPrice})
 }
 
-func report() {
+func report(ctx context.Context) {
 	now := time.Now()
 
 	var dayAvgRecord Record
@@ -147,5 +143,5 @@ func report() {
 		weekAvgRecord.AvalancheLowPrice, weekAvgRecord.AvalancheHighPrice,
 		weekAvgRecord.SolanaLowPrice, weekAvgRecord.SolanaHighPrice)
 
-	slack.ReportFee(slackMessage)
+	slack.ReportFee(ctx, slackMessage)
 }
@@ -1,11 +1,18 @@
 package monitor
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"math/big"
 	"math/rand"
 	"strconv"
+	"sync"
+	"time"
 
+	"psm-monitor/abi"
 	"psm-monitor/config"
+	"psm-monitor/db"
 	"psm-monitor/misc"
 	"psm-monitor/net"
 	"psm-monitor/slack"
@@ -13,112 +20,796 @@ import (
 	"github.com/robfig/cron"
 )
 
-const (
-	jTRX        = "TE2RzoSV3wFK99w6J9UnnZ4vLfXYoxvRwP"
-	jUSDD       = "TX7kybeP6UwTBRHLNPYmswFESHfyjm9bAS"
-	jUSDT       = "TXJgMdjVX5dKiQaUi9QobwNxtSQaFqccvd"
-	jSUN        = "TPXDpkg9e3eZzxqxAUyke9S4z4pGJBJw9e"
-	jBTT        = "TUaUHU9Dy8x5yNi1pKnFYqHWojot61Jfto"
-	jNFT        = "TFpPyDCKvNFgos3g3WVsAqMrdqhB81JXHE"
-	jJST        = "TWQhCXaWz4eHK4Kd1ErSDHjMFPoPc9czts"
-	jWIN        = "TRg6MnpsFXc82ymUPgf5qbj59ibxiEDWvv"
-	jUSDJ       = "TL5x9MtSnDy537FXKx53yAaHRRNdg9TkkA"
-	jUSDC       = "TNSBA6KvSvMoTqQcEgpVK7VhHT3z7wifxy"
-	jTUSD       = "TSXv71Fy5XdL3Rh2QfBoUu3NAaM4sMif8R"
-	jBTC        = "TLeEu311Cbw63BcmMHDgDLu7fnk9fqGcqT"
-	jETH        = "TR7BUFRQeq1w5jAZf1FKx85SHuX6PfMqsV"
-	jWBTT       = "TUY54PVeH6WCcYCd6ZXXoBDsHytN9V5PXt"
-	jSUNOLD     = "TGBr8uh9jBVHJhhkwSJvQN2ZAKzVkxDmno"
-	jController = "TGjYzgCyPobsNS9n6WcbdLVR9dH7mWqFx7"
-)
+// liquidationWindow is the rolling window of the liquidation volume alert
+const liquidationWindow = time.Hour
+
+// blocksPerDay is the number of blocks TRON produces in a day, one every 3 seconds
+const blocksPerDay = 24 * 60 * 60 / 3
+
+// priceTTL is how long a market price read from the oracle is reused
+const priceTTL = 10 * time.Minute
+
+// priceScale scales oracle prices, a price is the USD value of one raw unit of the underlying token
+var priceScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(36), nil)
 
 type market struct {
+	addr     string
 	symbol   string
 	decimals uint8
+
+	// price is the last oracle price of the underlying token, nil until it is read
+	price     *big.Int
+	priceTime time.Time
+}
+
+// marketState is a snapshot of a market, all amounts are raw units of the underlying token
+type marketState struct {
+	supply   *big.Int
+	borrows  *big.Int
+	cash     *big.Int
+	reserves *big.Int
+
+	// supplyRate and borrowRate are the interest rates per block, scaled by 1e18
+	supplyRate *big.Int
+	borrowRate *big.Int
+}
+
+// supplyAPY returns the supply rate compounded daily over a year, in percent
+func (s *marketState) supplyAPY() float64 {
+	return toAPY(s.supplyRate)
+}
+
+// borrowAPY returns the borrow rate compounded daily over a year, in percent
+func (s *marketState) borrowAPY() float64 {
+	return toAPY(s.borrowRate)
+}
+
+func toAPY(ratePerBlock *big.Int) float64 {
+	rate, _ := new(big.Rat).SetFrac(ratePerBlock, misc.GetDec(18)).Float64()
+	return (math.Pow(1+rate*blocksPerDay, 365) - 1) * 100
+}
+
+// utilization returns the share of the market liquidity lent out, in percent
+func (s *marketState) utilization() float64 {
+	liquidity := new(big.Int).Add(s.cash, s.borrows)
+	liquidity.Sub(liquidity, s.reserves)
+	if liquidity.Sign() <= 0 {
+		return 0
+	}
+	utilization, _ := new(big.Rat).SetFrac(s.borrows, liquidity).Float64()
+	return utilization * 100
+}
+
+// RateRecord is a sample of the utilization and APYs of a rate market, taken on every check
+type RateRecord struct {
+	ID          uint      `gorm:"primaryKey"`
+	TrackedAt   time.Time `gorm:"index"`
+	Market      string    `gorm:"index"`
+	Symbol      string
+	Utilization float64
+	SupplyAPY   float64
+	BorrowAPY   float64
+}
+
+// liquidation is the USD value repaid by a liquidation at the time of its block
+type liquidation struct {
+	at    time.Time
+	value *big.Int
+}
+
+// healthLevel is how close a watched account is to liquidation, by its health margin
+type healthLevel int
+
+const (
+	healthOK healthLevel = iota
+	healthWarning
+	healthCritical
+)
+
+func (l healthLevel) String() string {
+	switch l {
+	case healthWarning:
+		return "warning"
+	case healthCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// accountHealth is the borrow position of a watched account, amounts are whole dollars
+type accountHealth struct {
+	borrows   *big.Int
+	liquidity *big.Int
+	shortfall *big.Int
+	// positions describes the supply and borrows of the account in each market it uses
+	positions string
+}
+
+// margin returns the share of the borrow limit still unused in percent, negative once the account is short
+func (h *accountHealth) margin() float64 {
+	limit := new(big.Int).Add(h.borrows, h.liquidity)
+	limit.Sub(limit, h.shortfall)
+	if limit.Sign() <= 0 {
+		if h.borrows.Sign() == 0 {
+			return 100
+		}
+		return -100
+	}
+	margin, _ := new(big.Rat).SetFrac(new(big.Int).Sub(h.liquidity, h.shortfall), limit).Float64()
+	return margin * 100
+}
+
+func (h *accountHealth) level(warning, critical float64) healthLevel {
+	switch margin := h.margin(); {
+	case margin < critical:
+		return healthCritical
+	case margin < warning:
+		return healthWarning
+	}
+	return healthOK
 }
 
 type JST struct {
 	topic string
+	chain net.ChainProvider
 
-	markets map[string]market
-}
-
-func StartJST(c *cron.Cron, concerned map[string]func(event *net.Event)) {
-	jst := &JST{topic: ":justlend: [JST]", markets: make(map[string]market)}
-	jst.markets[jTRX] = market{symbol: "TRX", decimals: 8}
-	jst.markets[jUSDD] = market{symbol: "USDD", decimals: 18}
-	jst.markets[jUSDT] = market{symbol: "USDT", decimals: 6}
-	jst.markets[jSUN] = market{symbol: "SUN", decimals: 18}
-	jst.markets[jBTT] = market{symbol: "BTT", decimals: 18}
-	jst.markets[jNFT] = market{symbol: "NFT", decimals: 6}
-	jst.markets[jJST] = market{symbol: "JST", decimals: 18}
-	jst.markets[jWIN] = market{symbol: "WIN", decimals: 6}
-	jst.markets[jUSDJ] = market{symbol: "USDJ", decimals: 18}
-	jst.markets[jUSDC] = market{symbol: "USDC", decimals: 6}
-	jst.markets[jTUSD] = market{symbol: "TUSD", decimals: 18}
-	jst.markets[jBTC] = market{symbol: "BTC", decimals: 8}
-	jst.markets[jETH] = market{symbol: "ETH", decimals: 18}
-	jst.init()
-
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */10 * * * ?", misc.WrapLog(jst.check))
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(jst.report))
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(jst.stats))
-
-	concerned[jUSDD] = jst.handleStableCoin
-	concerned[jUSDT] = jst.handleStableCoin
-	concerned[jUSDJ] = jst.handleStableCoin
-	concerned[jUSDC] = jst.handleStableCoin
-	concerned[jTUSD] = jst.handleStableCoin
-}
-
-func (j *JST) handleStableCoin(event *net.Event) {
-	jMarket := j.markets[event.Address]
-	threshold := big.NewInt(config.Get().JST.StableThreshold)
-	switch event.EventName {
-	case "Borrow":
-		borrowAmount, _ := new(big.Int).SetString(event.Result["borrowAmount"], 10)
-		borrowAmount = misc.ConvertDecN(borrowAmount, jMarket.decimals)
-		borrower := event.Result["borrower"]
-		if borrowAmount.Cmp(threshold) >= 0 {
-			slack.SendMsg(j.topic, "Large %s, %s, %s, %s",
-				event.EventName,
-				misc.FormatTokenAmt(jMarket.symbol, borrowAmount, false),
-				misc.FormatUser(borrower),
-				misc.FormatTxUrl(event.TransactionHash))
+	// all tracked markets, in the order they are added
+	marketList []string
+	markets    map[string]*market
+
+	// check states for all tracked markets
+	cStates map[string]*marketState
+
+	// stats states for all tracked markets
+	sStates map[string]*marketState
+	sTime   time.Time
+
+	// rate markets whose APY move or utilization above the kink was alerted, cleared once back to normal
+	isAPYWarned  map[string]bool
+	isKinkWarned map[string]bool
+
+	// liquidations within the last liquidationWindow, oldest first
+	liquidations    []liquidation
+	isCascadeWarned bool
+
+	// priceLock guards the oracle address and the market prices
+	priceLock sync.Mutex
+	oracle    string
+
+	// healthLock serializes the health checks of the watched accounts, run by both the schedule and the event handlers
+	healthLock   sync.Mutex
+	healthLevels map[string]healthLevel
+	// checkedBlocks is the last block whose events re-checked a watched account, used by the event handlers only
+	checkedBlocks map[string]uint64
+
+	// isReplay skips the health checks of the event handlers, as the health read is the present one, not that of the event,
+	// and marks the USD values of the handlers as valued at the present price
+	isReplay bool
+}
+
+// StartJST starts the JustLend monitor, a nil c starts it for replay with the event handlers only,
+// its state and the health of the watched accounts are neither read nor reported
+func StartJST(ctx context.Context, c *cron.Cron, chain net.ChainProvider, concerned map[string]func(ctx context.Context, event *net.Event)) {
+	jst := &JST{
+		topic:   ":justlend: [JST]",
+		chain:   chain,
+		markets: make(map[string]*market),
+		cStates: make(map[string]*marketState),
+		sStates: make(map[string]*marketState),
+		sTime:   time.Now(),
+
+		isAPYWarned:   make(map[string]bool),
+		isKinkWarned:  make(map[string]bool),
+		healthLevels:  make(map[string]healthLevel),
+		checkedBlocks: make(map[string]uint64),
+	}
+	_ = db.Get().AutoMigrate(&RateRecord{})
+	jstConfig := config.Get().JST
+	for _, marketConfig := range jstConfig.Markets {
+		jst.addMarket(ctx, marketConfig)
+	}
+	if jstConfig.Discover {
+		jst.discoverMarkets(ctx, jstConfig.Comptroller)
+	}
+	if c == nil {
+		jst.isReplay = true
+	} else {
+		jst.init(ctx)
+
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */10 * * * ?", misc.WrapLog(ctx, jst.check))
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(ctx, jst.report))
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(ctx, jst.stats))
+	}
+
+	for addr := range jst.markets {
+		subscribe(concerned, addr, jst.handleMarketEvents)
+		subscribe(concerned, addr, jst.handleGovernanceEvents)
+	}
+	if len(jstConfig.Comptroller) != 0 {
+		subscribe(concerned, jstConfig.Comptroller, jst.handleGovernanceEvents)
+	}
+}
+
+// addMarket adds a market from its config, symbol and decimals of the underlying token are resolved on-chain when omitted
+func (j *JST) addMarket(ctx context.Context, marketConfig config.MarketConfig) {
+	jMarket := &market{addr: marketConfig.Address, symbol: marketConfig.Symbol, decimals: marketConfig.Decimals}
+	if len(jMarket.symbol) == 0 || jMarket.decimals == 0 {
+		underlying, err := abi.NewJToken(j.chain, jMarket.addr).Underlying(ctx)
+		if err != nil {
+			// only jTRX has no underlying token
+			underlying = ""
 		}
-	case "Redeem":
-		redeemAmount, _ := new(big.Int).SetString(event.Result["redeemAmount"], 10)
-		redeemAmount = misc.ConvertDecN(redeemAmount, jMarket.decimals)
-		redeemer := event.Result["redeemer"]
-		if redeemAmount.Cmp(threshold) >= 0 {
-			slack.SendMsg(j.topic, "Large %s, %s, %s, %s",
-				event.EventName,
-				misc.FormatTokenAmt(jMarket.symbol, redeemAmount, false),
-				misc.FormatUser(redeemer),
-				misc.FormatTxUrl(event.TransactionHash))
+		if len(jMarket.symbol) == 0 {
+			jMarket.symbol = "TRX"
+			if len(underlying) != 0 {
+				jMarket.symbol = abi.Name(ctx, j.chain, underlying)
+			}
+		}
+		if jMarket.decimals == 0 {
+			jMarket.decimals = 6
+			if len(underlying) != 0 {
+				jMarket.decimals = abi.Decimals(ctx, j.chain, underlying)
+			}
+		}
+	}
+	j.marketList = append(j.marketList, jMarket.addr)
+	j.markets[jMarket.addr] = jMarket
+}
+
+// discoverMarkets adds the markets listed by the comptroller which are not configured
+func (j *JST) discoverMarkets(ctx context.Context, comptroller string) {
+	markets, err := abi.NewComptroller(j.chain, comptroller).GetAllMarkets(ctx)
+	if err != nil {
+		misc.Warn(j.topic+".discoverMarkets", fmt.Sprintf("action=\"query all markets\" reason=\"%s\"", err.Error()))
+		return
+	}
+	for _, addr := range markets {
+		if _, ok := j.markets[addr]; !ok {
+			j.addMarket(ctx, config.MarketConfig{Address: addr})
+			misc.Info(j.topic+".discoverMarkets", fmt.Sprintf("market=%s symbol=%s", addr, j.markets[addr].symbol))
 		}
 	}
 }
 
-func (j *JST) handleMarketEvents(event *net.Event) {
+func (j *JST) handleMarketEvents(ctx context.Context, event *net.Event) {
+	jMarket, ok := j.markets[event.Address]
+	if !ok {
+		return
+	}
+	jstConfig := config.Get().JST
+	marketConfig := jstConfig.Market(event.Address)
+	var (
+		amount    *big.Int
+		user      string
+		threshold int64
+	)
 	switch event.EventName {
+	case "Borrow":
+		amount, user, threshold = event.BigInt("borrowAmount"), event.Addr("borrower"), marketConfig.BorrowThreshold
+	case "Redeem":
+		amount, user, threshold = event.BigInt("redeemAmount"), event.Addr("redeemer"), marketConfig.RedeemThreshold
+	case "Mint":
+		amount, user, threshold = event.BigInt("mintAmount"), event.Addr("minter"), marketConfig.MintThreshold
+	case "RepayBorrow":
+		amount, user, threshold = event.BigInt("repayAmount"), event.Addr("borrower"), marketConfig.RepayThreshold
 	case "LiquidateBorrow":
+		j.handleLiquidation(ctx, event, jMarket, marketConfig.LiquidationThreshold)
+		j.checkEventAccount(ctx, event, event.Addr("borrower"))
+		return
+	default:
+		return
+	}
+	j.checkEventAccount(ctx, event, user)
+	value := j.getUSDValue(ctx, jMarket, amount)
+	if value == nil {
+		misc.Warn(j.topic+".handleMarketEvents", fmt.Sprintf("action=\"value %s of j%s\" reason=\"no price\" tx=%s", event.EventName, jMarket.symbol, event.TransactionHash))
+		return
+	}
+	if value.Cmp(big.NewInt(threshold)) >= 0 {
+		slack.SendMsg(ctx, j.topic, "Large %s, %s, %s, %s, %s",
+			event.EventName,
+			misc.FormatTokenAmt(jMarket.symbol, misc.ConvertDecN(amount, jMarket.decimals), false),
+			j.formatUSDValue(value),
+			misc.FormatUser(user),
+			misc.FormatTxUrl(event.TransactionHash))
+	}
+}
+
+// handleGovernanceEvents reports the admin and risk parameter changes of the comptroller and the markets
+func (j *JST) handleGovernanceEvents(ctx context.Context, event *net.Event) {
+	var change string
+	switch event.EventName {
+	case "NewCollateralFactor":
+		change = fmt.Sprintf("collateral factor of %s - %s => %s", j.formatContract(event.Addr("cToken")),
+			formatMantissa(event.BigInt("oldCollateralFactorMantissa")), formatMantissa(event.BigInt("newCollateralFactorMantissa")))
+	case "NewLiquidationIncentive":
+		change = fmt.Sprintf("liquidation incentive - %s => %s",
+			formatMantissa(event.BigInt("oldLiquidationIncentiveMantissa")), formatMantissa(event.BigInt("newLiquidationIncentiveMantissa")))
+	case "NewCloseFactor":
+		change = fmt.Sprintf("close factor - %s => %s",
+			formatMantissa(event.BigInt("oldCloseFactorMantissa")), formatMantissa(event.BigInt("newCloseFactorMantissa")))
+	case "NewReserveFactor":
+		change = fmt.Sprintf("reserve factor of %s - %s => %s", j.formatContract(event.Address),
+			formatMantissa(event.BigInt("oldReserveFactorMantissa")), formatMantissa(event.BigInt("newReserveFactorMantissa")))
+	case "NewPriceOracle":
+		change = fmt.Sprintf("price oracle - `%s` => `%s`", event.Addr("oldPriceOracle"), event.Addr("newPriceOracle"))
+		j.resetPrices()
+	case "NewMarketInterestRateModel", "NewInterestRateModel":
+		change = fmt.Sprintf("interest rate model of %s - `%s` => `%s`", j.formatContract(event.Address),
+			event.Addr("oldInterestRateModel"), event.Addr("newInterestRateModel"))
+	case "ActionPaused":
+		// the comptroller emits it for all markets, or with cToken for one market
+		scope := "all markets"
+		if cToken := event.Addr("cToken"); len(cToken) != 0 {
+			scope = j.formatContract(cToken)
+		}
+		state := "unpaused"
+		if event.String("pauseState") == "true" {
+			state = "paused"
+		}
+		change = fmt.Sprintf("`%s` %s on %s", event.String("action"), state, scope)
+	case "NewPendingAdmin":
+		change = fmt.Sprintf("pending admin of %s - `%s` => `%s`", j.formatContract(event.Address),
+			event.Addr("oldPendingAdmin"), event.Addr("newPendingAdmin"))
+	case "NewAdmin":
+		change = fmt.Sprintf("admin of %s - `%s` => `%s`", j.formatContract(event.Address),
+			event.Addr("oldAdmin"), event.Addr("newAdmin"))
+	default:
+		return
+	}
+	slack.SendMsg(ctx, j.topic, ":rotating_light: Governance `%s`, %s, %s", event.EventName, change, misc.FormatTxUrl(event.TransactionHash))
+}
+
+// formatContract names the comptroller or a tracked market, other contracts are shown by address
+func (j *JST) formatContract(addr string) string {
+	if jMarket, ok := j.markets[addr]; ok {
+		return fmt.Sprintf("`j%s`", jMarket.symbol)
+	}
+	if addr == config.Get().JST.Comptroller {
+		return "`comptroller`"
+	}
+	return fmt.Sprintf("`%s`", addr)
+}
 
+// handleLiquidation reports a liquidation repaying jMarket, and the liquidation volume of the last hour
+// once it reaches the cascade threshold, measured by block time so catch-up and replay count alike.
+// A liquidation without a price is always reported, flagged as unvalued, and left out of the volume.
+func (j *JST) handleLiquidation(ctx context.Context, event *net.Event, jMarket *market, threshold int64) {
+	repayAmount := event.BigInt("repayAmount")
+	repayValue := j.getUSDValue(ctx, jMarket, repayAmount)
+	if repayValue == nil || repayValue.Cmp(big.NewInt(threshold)) >= 0 {
+		slack.SendMsg(ctx, j.topic, "Liquidation, liquidator %s, borrower %s, repay %s, %s, seize %s, %s",
+			misc.FormatUser(event.Addr("liquidator")),
+			misc.FormatUser(event.Addr("borrower")),
+			misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, repayAmount), false),
+			j.formatUSDValue(repayValue),
+			j.formatSeized(ctx, event.Addr("cTokenCollateral"), event.BigInt("seizeTokens")),
+			misc.FormatTxUrl(event.TransactionHash))
+	}
+	if repayValue == nil {
+		return
+	}
+
+	at := time.UnixMilli(event.BlockTimestamp)
+	j.liquidations = append(j.liquidations, liquidation{at: at, value: repayValue})
+	volume := big.NewInt(0)
+	for len(j.liquidations) > 0 && at.Sub(j.liquidations[0].at) > liquidationWindow {
+		j.liquidations = j.liquidations[1:]
+	}
+	for _, l := range j.liquidations {
+		volume.Add(volume, l.value)
+	}
+	volumeThreshold := big.NewInt(config.Get().JST.LiquidationVolumeThreshold)
+	if volumeThreshold.Sign() <= 0 {
+		return
+	}
+	if !j.isCascadeWarned && volume.Cmp(volumeThreshold) >= 0 {
+		j.isCascadeWarned = true
+		slack.SendMsg(ctx, j.topic, ":rotating_light: Liquidation volume in last `1h` reached %s, `%d` liquidations, latest %s",
+			j.formatUSDValue(volume), len(j.liquidations), misc.FormatTxUrl(event.TransactionHash))
+	}
+	if volume.Cmp(volumeThreshold) < 0 {
+		j.isCascadeWarned = false
+	}
+}
+
+// formatSeized formats seized jTokens of the collateral market as the underlying token and its USD value
+func (j *JST) formatSeized(ctx context.Context, collateral string, seizeTokens *big.Int) string {
+	collateralMarket, ok := j.markets[collateral]
+	if !ok {
+		return fmt.Sprintf("`%s` jTokens of untracked market `%s`", misc.ToReadableDec(seizeTokens), collateral)
+	}
+	exchangeRate, err := abi.NewJToken(j.chain, collateral).ExchangeRateStored(ctx)
+	if err != nil {
+		misc.Warn(j.topic+".formatSeized", fmt.Sprintf("action=\"query j%s exchange rate\" reason=\"%s\"", collateralMarket.symbol, err.Error()))
+		return fmt.Sprintf("`%s` j%s", misc.ToReadableDec(seizeTokens), collateralMarket.symbol)
+	}
+	seized := new(big.Int).Mul(seizeTokens, exchangeRate)
+	seized.Div(seized, misc.GetDec(18))
+	return misc.FormatTokenAmt(collateralMarket.symbol, j.toTokenAmt(collateralMarket, seized), false) + ", " +
+		j.formatUSDValue(j.getUSDValue(ctx, collateralMarket, seized))
+}
+
+// formatUSDValue formats a value of getUSDValue, flagging a value that could not be priced,
+// and on replay a value of a past event, which is read at the present price and exchange rate
+func (j *JST) formatUSDValue(value *big.Int) string {
+	if value == nil {
+		return ":dollar: - `unknown, no price`"
+	}
+	if j.isReplay {
+		return misc.FormatUSD(value) + " `at current price`"
+	}
+	return misc.FormatUSD(value)
+}
+
+// getUSDValue values a raw amount of the underlying token of the market in whole dollars,
+// it is nil when the price has never been read, callers skip or flag their USD checks then
+func (j *JST) getUSDValue(ctx context.Context, jMarket *market, amount *big.Int) *big.Int {
+	price := j.getPrice(ctx, jMarket)
+	if price == nil {
+		return nil
+	}
+	value := new(big.Int).Mul(amount, price)
+	return value.Div(value, priceScale)
+}
+
+// resetPrices makes the next getPrice read the oracle address and the prices again, the last prices are kept as fallback
+func (j *JST) resetPrices() {
+	j.priceLock.Lock()
+	defer j.priceLock.Unlock()
+	j.oracle = ""
+	for _, jMarket := range j.markets {
+		jMarket.priceTime = time.Time{}
+	}
+}
+
+// getPrice returns the oracle price of the underlying token of the market, cached for priceTTL,
+// the last price is kept when the oracle cannot be queried
+func (j *JST) getPrice(ctx context.Context, jMarket *market) *big.Int {
+	j.priceLock.Lock()
+	defer j.priceLock.Unlock()
+	if jMarket.price != nil && time.Since(jMarket.priceTime) < priceTTL {
+		return jMarket.price
+	}
+	if len(j.oracle) == 0 {
+		comptroller := config.Get().JST.Comptroller
+		if len(comptroller) == 0 {
+			return jMarket.price
+		}
+		oracle, err := abi.NewComptroller(j.chain, comptroller).Oracle(ctx)
+		if err != nil {
+			misc.Warn(j.topic+".getPrice", fmt.Sprintf("action=\"query oracle\" reason=\"%s\"", err.Error()))
+			return jMarket.price
+		}
+		j.oracle = oracle
+	}
+	price, err := abi.NewPriceOracle(j.chain, j.oracle).GetUnderlyingPrice(ctx, jMarket.addr)
+	if err != nil {
+		misc.Warn(j.topic+".getPrice", fmt.Sprintf("action=\"query %s price\" reason=\"%s\"", jMarket.symbol, err.Error()))
+		return jMarket.price
+	}
+	jMarket.price, jMarket.priceTime = price, time.Now()
+	return price
+}
+
+func (j *JST) init(ctx context.Context) {
+	states := j.getStates(ctx)
+	for addr, state := range states {
+		j.cStates[addr] = state
+		j.sStates[addr] = state
+	}
+	j.report(ctx)
+}
+
+func (j *JST) check(ctx context.Context) {
+	states := j.getStates(ctx)
+	jstConfig := config.Get().JST
+	reportThreshold := big.NewInt(jstConfig.ReportThreshold)
+	for _, addr := range j.marketList {
+		jMarket, state, pre := j.markets[addr], states[addr], j.cStates[addr]
+		if state == nil || pre == nil {
+			continue
+		}
+		isLarge := false
+		for _, diff := range []*big.Int{
+			new(big.Int).Sub(state.supply, pre.supply),
+			new(big.Int).Sub(state.borrows, pre.borrows),
+			new(big.Int).Sub(state.cash, pre.cash),
+		} {
+			// a market without a price only reports its utilization change
+			if value := j.getUSDValue(ctx, jMarket, diff); value != nil && value.CmpAbs(reportThreshold) >= 0 {
+				isLarge = true
+			}
+		}
+		utilization, preUtilization := state.utilization(), pre.utilization()
+		if jstConfig.UtilizationThreshold > 0 && math.Abs(utilization-preUtilization) >= jstConfig.UtilizationThreshold {
+			isLarge = true
+		}
+		if isLarge {
+			slack.SendMsg(ctx, j.topic, "Large market change in last `10min`, %s, utilization - `%.2f%%` => `%.2f%%` in `j%s`",
+				j.formatDiffs(jMarket, state, pre), preUtilization, utilization, jMarket.symbol)
+		}
+		j.cStates[addr] = state
+	}
+	j.checkRates(ctx, states)
+	j.checkAccounts(ctx, jstConfig.Accounts)
+}
+
+// checkRates records the APYs of the rate markets, and alerts when the utilization goes above the kink
+// or an APY moved more than the threshold since the earliest record within the last hour
+func (j *JST) checkRates(ctx context.Context, states map[string]*marketState) {
+	jstConfig := config.Get().JST
+	now := time.Now()
+	for _, addr := range j.marketList {
+		jMarket, state := j.markets[addr], states[addr]
+		if state == nil || !jstConfig.TracksRate(jMarket.symbol) {
+			continue
+		}
+		record := RateRecord{
+			TrackedAt:   now,
+			Market:      addr,
+			Symbol:      jMarket.symbol,
+			Utilization: state.utilization(),
+			SupplyAPY:   state.supplyAPY(),
+			BorrowAPY:   state.borrowAPY(),
+		}
+		var pre RateRecord
+		found := db.Get().Where("market = ? AND tracked_at >= ?", addr, now.Add(-time.Hour)).
+			Order("tracked_at").Limit(1).Find(&pre).RowsAffected > 0
+		if err := db.Get().Create(&record).Error; err != nil {
+			misc.Warn(j.topic+".checkRates", fmt.Sprintf("action=\"save j%s rates\" reason=\"%s\"", jMarket.symbol, err.Error()))
+		}
+
+		if kink := jstConfig.Market(addr).Kink; kink > 0 {
+			if !j.isKinkWarned[addr] && record.Utilization >= kink {
+				j.isKinkWarned[addr] = true
+				slack.SendMsg(ctx, j.topic, ":warning: Utilization of `j%s` is above kink `%.2f%%`, utilization - `%.2f%%`, supply APY - `%.2f%%`, borrow APY - `%.2f%%`",
+					jMarket.symbol, kink, record.Utilization, record.SupplyAPY, record.BorrowAPY)
+			}
+			if record.Utilization < kink {
+				j.isKinkWarned[addr] = false
+			}
+		}
+
+		if !found || jstConfig.APYThreshold <= 0 {
+			continue
+		}
+		// APYs are in percent, a basis point is 0.01 of them
+		supplyMove := (record.SupplyAPY - pre.SupplyAPY) * 100
+		borrowMove := (record.BorrowAPY - pre.BorrowAPY) * 100
+		isMoved := math.Abs(supplyMove) >= jstConfig.APYThreshold || math.Abs(borrowMove) >= jstConfig.APYThreshold
+		if !j.isAPYWarned[addr] && isMoved {
+			slack.SendMsg(ctx, j.topic, ":warning: APY of `j%s` moved since `%s`, supply APY - `%.2f%%` => `%.2f%%` (`%+.0f` bps), borrow APY - `%.2f%%` => `%.2f%%` (`%+.0f` bps), utilization - `%.2f%%` => `%.2f%%`",
+				jMarket.symbol, pre.TrackedAt.Format("15:04"),
+				pre.SupplyAPY, record.SupplyAPY, supplyMove,
+				pre.BorrowAPY, record.BorrowAPY, borrowMove,
+				pre.Utilization, record.Utilization)
+		}
+		j.isAPYWarned[addr] = isMoved
 	}
 }
 
-func (j *JST) init() {
+// checkEventAccount re-checks the health of the account touched by the event if it is watched,
+// at most once per block, as the health read after the block is the same for all its events
+func (j *JST) checkEventAccount(ctx context.Context, event *net.Event, user string) {
+	account, ok := config.Get().JST.Account(user)
+	if !ok || j.isReplay || j.checkedBlocks[user] == event.BlockNumber {
+		return
+	}
+	j.checkedBlocks[user] = event.BlockNumber
+	j.checkAccounts(ctx, []config.AccountConfig{account})
+}
+
+// checkAccounts alerts when the health level of a watched account changes, both as it drops and as it recovers
+func (j *JST) checkAccounts(ctx context.Context, accounts []config.AccountConfig) {
+	if len(accounts) == 0 {
+		return
+	}
+	j.healthLock.Lock()
+	defer j.healthLock.Unlock()
+	jstConfig := config.Get().JST
+	healths := j.getHealths(ctx, jstConfig.Comptroller, accounts)
+	for _, account := range accounts {
+		health, ok := healths[account.Address]
+		if !ok {
+			continue
+		}
+		level, pre := health.level(jstConfig.HealthWarning, jstConfig.HealthCritical), j.healthLevels[account.Address]
+		if level == pre {
+			continue
+		}
+		j.healthLevels[account.Address] = level
+		name := misc.FormatUser(account.Address)
+		if len(account.Name) != 0 {
+			name = fmt.Sprintf("`%s` %s", account.Name, name)
+		}
+		emoji := ":white_check_mark:"
+		switch {
+		case level == healthCritical:
+			emoji = ":rotating_light:"
+		case level > pre:
+			emoji = ":warning:"
+		}
+		slack.SendMsg(ctx, j.topic, "%s Account health of %s - `%s` => `%s`, margin `%.2f%%`, borrows %s, liquidity %s, shortfall %s%s",
+			emoji, name, pre, level, health.margin(),
+			misc.FormatUSD(health.borrows),
+			misc.FormatUSD(health.liquidity),
+			misc.FormatUSD(health.shortfall),
+			health.positions)
+	}
+}
+
+// getHealths reads the liquidity and the position in every market of the accounts in one multicall,
+// an account that cannot be fully read is left out, so that a partial position never looks healthier
+func (j *JST) getHealths(ctx context.Context, comptroller string, accounts []config.AccountConfig) map[string]*accountHealth {
+	healths := make(map[string]*accountHealth)
+	if len(comptroller) == 0 {
+		return healths
+	}
+	type accountCalls struct {
+		liquidity *abi.Call
+		snapshots map[string]*abi.Call
+	}
+	multicall := abi.NewMulticall(j.chain)
+	unitroller := abi.NewComptroller(j.chain, comptroller).Contract
+	calls := make(map[string]*accountCalls)
+	for _, account := range accounts {
+		c := &accountCalls{
+			liquidity: multicall.Add(unitroller, "getAccountLiquidity", account.Address),
+			snapshots: make(map[string]*abi.Call),
+		}
+		for _, addr := range j.marketList {
+			c.snapshots[addr] = multicall.Add(abi.NewJToken(j.chain, addr).Contract, "getAccountSnapshot", account.Address)
+		}
+		calls[account.Address] = c
+	}
+	_, _ = multicall.Do(ctx)
 
+accounts:
+	for account, c := range calls {
+		values, err := c.liquidity.ErrorCodeOutputs()
+		if err != nil {
+			misc.Warn(j.topic+".getHealths", fmt.Sprintf("action=\"query %s liquidity\" reason=\"%s\"", account, err.Error()))
+			continue
+		}
+		// the comptroller values liquidity and shortfall in USD scaled by 1e18
+		health := &accountHealth{
+			borrows:   big.NewInt(0),
+			liquidity: new(big.Int).Div(values[0], misc.GetDec(18)),
+			shortfall: new(big.Int).Div(values[1], misc.GetDec(18)),
+		}
+		for _, addr := range j.marketList {
+			jMarket := j.markets[addr]
+			snapshot, err := c.snapshots[addr].ErrorCodeOutputs()
+			if err != nil {
+				misc.Warn(j.topic+".getHealths", fmt.Sprintf("action=\"query %s j%s snapshot\" reason=\"%s\"", account, jMarket.symbol, err.Error()))
+				continue accounts
+			}
+			balance, borrowBalance, exchangeRate := snapshot[0], snapshot[1], snapshot[2]
+			if balance.Sign() == 0 && borrowBalance.Sign() == 0 {
+				continue
+			}
+			supply := new(big.Int).Mul(balance, exchangeRate)
+			supply.Div(supply, misc.GetDec(18))
+			// an unpriced position would make the account look healthier than it is
+			borrowValue := j.getUSDValue(ctx, jMarket, borrowBalance)
+			if borrowValue == nil {
+				misc.Warn(j.topic+".getHealths", fmt.Sprintf("action=\"value %s j%s position\" reason=\"no price\"", account, jMarket.symbol))
+				continue accounts
+			}
+			health.borrows.Add(health.borrows, borrowValue)
+			health.positions += fmt.Sprintf("\n`j%s` supply %s, %s, borrow %s, %s",
+				jMarket.symbol,
+				misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, supply), false),
+				misc.FormatUSD(j.getUSDValue(ctx, jMarket, supply)),
+				misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, borrowBalance), false),
+				misc.FormatUSD(borrowValue))
+		}
+		healths[account] = health
+	}
+	return healths
 }
 
-func (j *JST) check() {
+func (j *JST) report(ctx context.Context) {
+	states := j.getStates(ctx)
+	jstConfig := config.Get().JST
+	reportStr := ""
+	for _, addr := range j.marketList {
+		jMarket, state := j.markets[addr], states[addr]
+		if state == nil {
+			continue
+		}
+		reportStr += fmt.Sprintf("\n`j%s` supply %s, borrows %s, cash %s, utilization - `%.2f%%`",
+			jMarket.symbol,
+			misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, state.supply), false),
+			misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, state.borrows), false),
+			misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, state.cash), false),
+			state.utilization())
+		if jstConfig.TracksRate(jMarket.symbol) {
+			reportStr += fmt.Sprintf(", supply APY - `%.2f%%`, borrow APY - `%.2f%%`", state.supplyAPY(), state.borrowAPY())
+		}
+	}
+	slack.SendMsg(ctx, j.topic, "State Report%s", reportStr)
+}
 
+func (j *JST) stats(ctx context.Context) {
+	states, now := j.getStates(ctx), time.Now()
+	statsStr := ""
+	for _, addr := range j.marketList {
+		jMarket, state, pre := j.markets[addr], states[addr], j.sStates[addr]
+		if state == nil || pre == nil {
+			continue
+		}
+		statsStr += fmt.Sprintf("\n`j%s` %s, utilization - `%.2f%%` => `%.2f%%`",
+			jMarket.symbol, j.formatDiffs(jMarket, state, pre), pre.utilization(), state.utilization())
+		j.sStates[addr] = state
+	}
+	slack.SendMsg(ctx, j.topic, "Stats Report, from `%s` ~ `%s`%s",
+		j.sTime.Format("15:04"), now.Format("15:04"), statsStr)
+	j.sTime = now
 }
 
-func (j *JST) report() {
+func (j *JST) formatDiffs(jMarket *market, state, pre *marketState) string {
+	return fmt.Sprintf("supply %s, borrows %s, cash %s",
+		misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, new(big.Int).Sub(state.supply, pre.supply)), true),
+		misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, new(big.Int).Sub(state.borrows, pre.borrows)), true),
+		misc.FormatTokenAmt(jMarket.symbol, j.toTokenAmt(jMarket, new(big.Int).Sub(state.cash, pre.cash)), true))
+}
 
+// toTokenAmt converts a raw amount of the underlying token to whole tokens, without touching amount
+func (j *JST) toTokenAmt(jMarket *market, amount *big.Int) *big.Int {
+	return misc.ConvertDecN(new(big.Int).Set(amount), jMarket.decimals)
 }
 
-func (j *JST) stats() {
+// getStates reads every market in one multicall, a market that cannot be read falls back to its c-state
+func (j *JST) getStates(ctx context.Context) map[string]*marketState {
+	type marketCalls struct {
+		totalSupply, exchangeRate, borrows, cash, reserves, supplyRate, borrowRate *abi.Call
+	}
+	multicall := abi.NewMulticall(j.chain)
+	calls := make(map[string]*marketCalls)
+	for _, addr := range j.marketList {
+		jToken := abi.NewJToken(j.chain, addr).Contract
+		calls[addr] = &marketCalls{
+			totalSupply:  multicall.Add(jToken, "totalSupply"),
+			exchangeRate: multicall.Add(jToken, "exchangeRateStored"),
+			borrows:      multicall.Add(jToken, "totalBorrowsCurrent"),
+			cash:         multicall.Add(jToken, "getCash"),
+			reserves:     multicall.Add(jToken, "totalReserves"),
+			supplyRate:   multicall.Add(jToken, "supplyRatePerBlock"),
+			borrowRate:   multicall.Add(jToken, "borrowRatePerBlock"),
+		}
+	}
+	_, _ = multicall.Do(ctx)
+
+	states := make(map[string]*marketState)
+	for addr, c := range calls {
+		values := make([]*big.Int, 0, 7)
+		var err error
+		for _, call := range []*abi.Call{c.totalSupply, c.exchangeRate, c.borrows, c.cash, c.reserves, c.supplyRate, c.borrowRate} {
+			var value *big.Int
+			if value, err = call.BigInt(); err != nil {
+				break
+			}
+			values = append(values, value)
+		}
+		if err != nil {
+			// if we cannot get current market state, return the c-state
+			misc.Warn(j.topic+".getStates", fmt.Sprintf("action=\"query j%s state\" reason=\"%s\"", j.markets[addr].symbol, err.Error()))
+			states[addr] = j.cStates[addr]
+			continue
+		}
+		// jToken amounts convert to the underlying token by the exchange rate, scaled by 1e18
+		supply := new(big.Int).Mul(values[0], values[1])
+		states[addr] = &marketState{
+			supply:   supply.Div(supply, misc.GetDec(18)),
+			borrows:  values[2],
+			cash:     values[3],
+			reserves: values[4],
 
+			supplyRate: values[5],
+			borrowRate: values[6],
+		}
+	}
+	return states
 }
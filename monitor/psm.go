@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"math/rand"
@@ -8,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"psm-monitor/abi"
 	"psm-monitor/config"
 	"psm-monitor/misc"
 	"psm-monitor/net"
@@ -17,58 +19,86 @@ import (
 )
 
 type ilk struct {
+	name    string
 	token   string
 	gemJoin string
 	psm     string
 	decimal uint8
+
+	// id and vat are the collateral type of the PSM and the vat holding its debt, vat is empty when they cannot be read
+	id  [32]byte
+	vat string
+}
+
+// ilkState is a snapshot of the fees and the debt of an ilk
+type ilkState struct {
+	// tin and tout are the PSM fees, scaled by 1e18
+	tin  *big.Int
+	tout *big.Int
+	// debt and line are the debt and debt ceiling of the ilk, scaled by 1e45
+	debt *big.Int
+	line *big.Int
+}
+
+// ceilingRemoved reports whether the debt ceiling of the ilk was set to zero, as it is when the ilk is offboarded
+func (s *ilkState) ceilingRemoved() bool {
+	return s.line.Sign() <= 0
+}
+
+// utilization returns the share of the debt ceiling used, in percent, and 0 when the ceiling is removed
+func (s *ilkState) utilization() float64 {
+	if s.ceilingRemoved() {
+		return 0
+	}
+	utilization, _ := new(big.Rat).SetFrac(s.debt, s.line).Float64()
+	return utilization * 100
+}
+
+// capacity returns how much USDD can still be minted by selling gems, in whole tokens
+func (s *ilkState) capacity() *big.Int {
+	capacity := new(big.Int).Sub(s.line, s.debt)
+	if capacity.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return capacity.Div(capacity, misc.GetDec(45))
+}
+
+// debtAmount returns the debt of the ilk, in whole tokens
+func (s *ilkState) debtAmount() *big.Int {
+	return new(big.Int).Div(s.debt, misc.GetDec(45))
+}
+
+// utilizationLevel returns how many of the ascending levels the utilization reached
+func utilizationLevel(utilization float64, levels []float64) int {
+	level := 0
+	for level < len(levels) && utilization >= levels[level] {
+		level++
+	}
+	return level
 }
 
 const (
 	USDD         = "USDD"
 	USDD_DaiJoin = "TMgSSHn8APyUVViqXxtveqFEB7mBBeGqNP"
-	USDT         = "USDT"
-	USDC         = "USDC"
-	TUSD         = "TUSD"
-	USDJ         = "USDJ"
 )
 
-var ilkList = [...]string{"USDT", "USDC", "TUSD", "USDJ"}
-var ilks = map[string]*ilk{
-	USDT: {
-		token:   "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t",
-		gemJoin: "TMn5WeW8a8KH9o8rBQux4RCgckD2SuMZmS",
-		psm:     "TM9gWuCdFGNMiT1qTq1bgw4tNhJbsESfjA",
-		decimal: 6,
-	},
-	USDC: {
-		token:   "TEkxiTehnzSmSe2XqrBj4w32RUN966rdz8",
-		gemJoin: "TRGTuMiDYAbztetdndYyMzYvtaRmucjz5q",
-		psm:     "TUcj1rpMgJCcFZULyq7uLbkmfh9xMnYTmA",
-		decimal: 6,
-	},
-	TUSD: {
-		token:   "TUpMhErZL2fhh4sVNULAbNKLokS4GjC1F4",
-		gemJoin: "TPxcmB9dQC3LHswCNEc4rJs1HFGb8McYjT",
-		psm:     "TY2op6AKcEkFhv8hxNJj3FBUfjManxYLSe",
-		decimal: 18,
-	},
-	USDJ: {
-		token:   "TMwFHYXLJaRUPeW6421aqXL4ZEzPRFGkGT",
-		gemJoin: "TKAovR61zwp1t9Rg1UE4UY5mXt7QTJdDXg",
-		psm:     "TVS3rVDUSd3ySeXV5moRH2J2t5B9reJfLR",
-		decimal: 18,
-	},
-}
-
 type PSM struct {
 	topic string
-	ilks  map[string]*ilk
+	chain net.ChainProvider
+
+	// all tracked ilks, in the order of config
+	ilkList []string
+	ilks    map[string]*ilk
 
 	isLowUSDDWarned bool
 
 	// check balances for all tracked token
 	cBalance map[string]*big.Int
 
+	// check fees and debts, and the utilization levels reached, for all tracked ilks
+	cStates    map[string]*ilkState
+	debtLevels map[string]int
+
 	// report balances for all tracked token
 	rBalance map[string]*big.Int
 
@@ -77,128 +107,296 @@ type PSM struct {
 	sTime    time.Time
 }
 
-func StartPSM(c *cron.Cron, concerned map[string]func(event *net.Event)) {
+// StartPSM starts the PSM monitor, a nil c starts it for replay with the event handlers only,
+// its state is neither read nor reported
+func StartPSM(ctx context.Context, c *cron.Cron, chain net.ChainProvider, concerned map[string]func(ctx context.Context, event *net.Event)) {
 	psm := &PSM{
 		topic:    ":usdd: [PSM]",
+		chain:    chain,
+		ilks:     make(map[string]*ilk),
 		cBalance: make(map[string]*big.Int),
 		rBalance: make(map[string]*big.Int),
 		sBalance: make(map[string]*big.Int),
 		sTime:    time.Now(),
+
+		cStates:    make(map[string]*ilkState),
+		debtLevels: make(map[string]int),
+	}
+	for _, ilkConfig := range config.Get().PSM.Ilks {
+		gem := psm.newIlk(ctx, ilkConfig)
+		psm.ilkList = append(psm.ilkList, gem.name)
+		psm.ilks[gem.name] = gem
+		subscribe(concerned, gem.psm, func(ctx context.Context, event *net.Event) {
+			psm.handleGemEvents(ctx, event, gem)
+		})
 	}
-	psm.init()
+	if c == nil {
+		return
+	}
+	psm.init(ctx)
 
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */10 * * * ?", misc.WrapLog(psm.check))
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(psm.report))
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(psm.stats))
+	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */10 * * * ?", misc.WrapLog(ctx, psm.check))
+	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(ctx, psm.report))
+	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(ctx, psm.stats))
+}
 
-	for _, name := range ilkList {
-		concerned[ilks[name].psm] = psm.handleGemEvents
+// newIlk builds an ilk from its config, symbol and decimals are resolved on-chain when omitted
+func (p *PSM) newIlk(ctx context.Context, ilkConfig config.IlkConfig) *ilk {
+	gem := &ilk{
+		name:    ilkConfig.Symbol,
+		token:   ilkConfig.Token,
+		gemJoin: ilkConfig.GemJoin,
+		psm:     ilkConfig.PSM,
+		decimal: ilkConfig.Decimals,
 	}
+	if len(gem.name) == 0 {
+		gem.name = abi.Name(ctx, p.chain, gem.token)
+	}
+	if len(gem.name) == 0 {
+		gem.name = gem.token
+	}
+	if gem.decimal == 0 {
+		gem.decimal = abi.Decimals(ctx, p.chain, gem.token)
+	}
+	psm := abi.NewPSM(p.chain, gem.psm)
+	id, err := psm.Ilk(ctx)
+	if err == nil {
+		gem.vat, err = psm.Vat(ctx)
+	}
+	if err != nil {
+		misc.Warn(p.topic+".newIlk", fmt.Sprintf("action=\"query %s ilk\" reason=\"%s\"", gem.name, err.Error()))
+		gem.vat = ""
+	}
+	gem.id = id
+	return gem
 }
 
-func (p *PSM) handleGemEvents(event *net.Event) {
-	var matchedName string
-	for _, name := range ilkList {
-		if strings.Compare(event.Address, ilks[name].psm) == 0 {
-			matchedName = name
-		}
-	}
-	amount, _ := new(big.Int).SetString(event.Result["value"], 10)
-	amount = misc.ConvertDecN(amount, ilks[matchedName].decimal)
+func (p *PSM) handleGemEvents(ctx context.Context, event *net.Event, gem *ilk) {
+	amount := misc.ConvertDecN(event.BigInt("value"), gem.decimal)
 	if strings.Compare(event.EventName, "BuyGem") == 0 {
 		amount = amount.Neg(amount)
 	}
-	if amount.CmpAbs(big.NewInt(config.Get().PSM.GemThreshold)) >= 0 {
-		slack.SendMsg(p.topic, "Large %s, %s, %s, %s",
+	if amount.CmpAbs(big.NewInt(config.Get().PSM.Ilk(gem.token).GemThreshold)) >= 0 {
+		slack.SendMsg(ctx, p.topic, "Large %s, %s, %s, %s",
 			event.EventName,
-			misc.FormatTokenAmt(matchedName, amount, true),
-			misc.FormatUser(net.GetTxFrom(event.TransactionHash)),
+			misc.FormatTokenAmt(gem.name, amount, true),
+			misc.FormatUser(getTxFrom(ctx, p.chain, event.TransactionHash)),
 			misc.FormatTxUrl(event.TransactionHash))
 	}
 }
 
-func (p *PSM) init() {
-	p.cBalance[USDD] = p.getUSDDBalance()
-	p.rBalance[USDD] = big.NewInt(-1)
-	p.sBalance[USDD] = p.cBalance[USDD]
-	for _, name := range ilkList {
-		p.cBalance[name] = p.getTokenBalance(name)
+func (p *PSM) init(ctx context.Context) {
+	balances := p.getBalances(ctx)
+	for name, balance := range balances {
+		p.cBalance[name] = balance
 		p.rBalance[name] = big.NewInt(-1)
-		p.sBalance[name] = p.cBalance[name]
+		p.sBalance[name] = balance
 	}
-	p.report()
+	levels := config.Get().PSM.UtilizationLevels
+	for name, state := range p.getIlkStates(ctx) {
+		if state == nil {
+			continue
+		}
+		p.cStates[name] = state
+		if !state.ceilingRemoved() {
+			p.debtLevels[name] = utilizationLevel(state.utilization(), levels)
+		}
+	}
+	p.report(ctx)
 }
 
-func (p *PSM) check() {
+func (p *PSM) check(ctx context.Context) {
+	balances := p.getBalances(ctx)
 	// check if each ilk`s balance change big
-	reportThreshold := big.NewInt(config.Get().PSM.ReportThreshold)
-	for _, name := range ilkList {
-		balanceOfToken := p.getTokenBalance(name)
+	for _, name := range p.ilkList {
+		reportThreshold := big.NewInt(config.Get().PSM.Ilk(p.ilks[name].token).ReportThreshold)
+		balanceOfToken := balances[name]
 		diff := big.NewInt(0)
 		diff = diff.Sub(balanceOfToken, p.cBalance[name])
 		if diff.CmpAbs(reportThreshold) >= 0 {
-			slack.SendMsg(p.topic, "Large gem balance change in last `10min`, %s",
+			slack.SendMsg(ctx, p.topic, "Large gem balance change in last `10min`, %s",
 				misc.FormatTokenAmt(name, diff, true))
-			p.report()
+			p.report(ctx)
 		}
 		p.cBalance[name] = balanceOfToken
 	}
 
 	// check if Vault remained USDD balance lower than threshold
-	balanceOfUSDD := p.getUSDDBalance()
+	balanceOfUSDD := balances[USDD]
 	daiThreshold := big.NewInt(config.Get().PSM.DaiThreshold)
 	if !p.isLowUSDDWarned && balanceOfUSDD.CmpAbs(daiThreshold) < 0 {
 		p.isLowUSDDWarned = true
-		slack.SendMsg(p.topic, "Vault remained USDD balance lower than %s",
+		slack.SendMsg(ctx, p.topic, "Vault remained USDD balance lower than %s",
 			misc.ToReadableDec(daiThreshold))
 	}
 	if balanceOfUSDD.CmpAbs(daiThreshold) >= 0 {
 		p.isLowUSDDWarned = false
 	}
 	p.cBalance[USDD] = balanceOfUSDD
+
+	p.checkIlks(ctx)
+}
+
+// checkIlks alerts when the fees of a PSM change, when the debt utilization of an ilk crosses a level either way,
+// and once when the debt ceiling of an ilk is removed or restored
+func (p *PSM) checkIlks(ctx context.Context) {
+	states := p.getIlkStates(ctx)
+	levels := config.Get().PSM.UtilizationLevels
+	for _, name := range p.ilkList {
+		state, pre := states[name], p.cStates[name]
+		if state == nil {
+			continue
+		}
+		if pre != nil && (state.tin.Cmp(pre.tin) != 0 || state.tout.Cmp(pre.tout) != 0) {
+			slack.SendMsg(ctx, p.topic, ":warning: Fees of `%s` PSM changed, tin - %s => %s, tout - %s => %s",
+				name, formatMantissa(pre.tin), formatMantissa(state.tin), formatMantissa(pre.tout), formatMantissa(state.tout))
+		}
+
+		if state.ceilingRemoved() {
+			if pre == nil || !pre.ceilingRemoved() {
+				slack.SendMsg(ctx, p.topic, ":warning: Debt ceiling of `%s` was removed, debt %s",
+					name, misc.FormatTokenAmt(USDD, state.debtAmount(), false))
+			}
+			p.debtLevels[name] = 0
+			p.cStates[name] = state
+			continue
+		}
+		if pre != nil && pre.ceilingRemoved() {
+			slack.SendMsg(ctx, p.topic, ":white_check_mark: Debt ceiling of `%s` was restored, utilization - `%.2f%%`, remaining capacity %s",
+				name, state.utilization(), misc.FormatTokenAmt(USDD, state.capacity(), false))
+		}
+
+		utilization := state.utilization()
+		level, preLevel := utilizationLevel(utilization, levels), p.debtLevels[name]
+		switch {
+		case level > preLevel:
+			emoji := ":warning:"
+			if utilization >= 100 {
+				emoji = ":rotating_light:"
+			}
+			slack.SendMsg(ctx, p.topic, "%s Debt ceiling utilization of `%s` reached `%.0f%%`, utilization - `%.2f%%`, remaining capacity %s",
+				emoji, name, levels[level-1], utilization, misc.FormatTokenAmt(USDD, state.capacity(), false))
+		case level < preLevel && level < len(levels):
+			slack.SendMsg(ctx, p.topic, ":white_check_mark: Debt ceiling utilization of `%s` fell below `%.0f%%`, utilization - `%.2f%%`, remaining capacity %s",
+				name, levels[level], utilization, misc.FormatTokenAmt(USDD, state.capacity(), false))
+		}
+		p.debtLevels[name] = level
+		p.cStates[name] = state
+	}
 }
 
-func (p *PSM) report() {
+func (p *PSM) report(ctx context.Context) {
+	balances := p.getBalances(ctx)
 	ilkReportStr := ""
-	for _, name := range ilkList {
-		p.rBalance[name] = p.getTokenBalance(name)
+	for _, name := range p.ilkList {
+		p.rBalance[name] = balances[name]
 		ilkReportStr += ", " + misc.FormatTokenAmt(name, p.rBalance[name], false)
 	}
-	slack.SendMsg(p.topic, "State Report, %s%s",
-		misc.FormatTokenAmt(USDD, p.getUSDDBalance(), false), ilkReportStr)
+	states := p.getIlkStates(ctx)
+	for _, name := range p.ilkList {
+		state := states[name]
+		if state == nil {
+			continue
+		}
+		if state.ceilingRemoved() {
+			ilkReportStr += fmt.Sprintf("\n`%s` debt ceiling removed, debt %s, tin - %s, tout - %s",
+				name, misc.FormatTokenAmt(USDD, state.debtAmount(), false), formatMantissa(state.tin), formatMantissa(state.tout))
+			continue
+		}
+		ilkReportStr += fmt.Sprintf("\n`%s` remaining capacity %s, utilization - `%.2f%%`, tin - %s, tout - %s",
+			name, misc.FormatTokenAmt(USDD, state.capacity(), false), state.utilization(), formatMantissa(state.tin), formatMantissa(state.tout))
+	}
+	slack.SendMsg(ctx, p.topic, "State Report, %s%s",
+		misc.FormatTokenAmt(USDD, balances[USDD], false), ilkReportStr)
 }
 
-func (p *PSM) stats() {
-	balanceOfUSDD, now := p.getUSDDBalance(), time.Now()
+func (p *PSM) stats(ctx context.Context) {
+	balances, now := p.getBalances(ctx), time.Now()
+	balanceOfUSDD := balances[USDD]
 	ilkStatsStr := ""
-	for _, name := range ilkList {
-		balanceOfToken := p.getTokenBalance(name)
-		ilkStatsStr += ", " + misc.FormatTokenAmt(name, p.sBalance[name].Sub(balanceOfToken, p.sBalance[name]), true)
+	for _, name := range p.ilkList {
+		balanceOfToken := balances[name]
+		ilkStatsStr += ", " + misc.FormatTokenAmt(name, new(big.Int).Sub(balanceOfToken, p.sBalance[name]), true)
 	}
-	slack.SendMsg(p.topic, "Stats Report, from `%s` ~ `%s`, %s%s",
+	slack.SendMsg(ctx, p.topic, "Stats Report, from `%s` ~ `%s`, %s%s",
 		p.sTime.Format("15:04"), now.Format("15:04"),
-		misc.FormatTokenAmt(USDD, p.sBalance[USDD].Sub(balanceOfUSDD, p.sBalance[USDD]), true),
+		misc.FormatTokenAmt(USDD, new(big.Int).Sub(balanceOfUSDD, p.sBalance[USDD]), true),
 		ilkStatsStr)
-	p.sBalance[USDD], p.sTime = balanceOfUSDD, now
+	for name, balance := range balances {
+		p.sBalance[name] = balance
+	}
+	p.sTime = now
 }
 
-func (p *PSM) getUSDDBalance() *big.Int {
-	result, err := net.Trigger(USDD_DaiJoin, "getUsddBalance()", "")
-	if err != nil {
-		// if we cannot get current USDD balance, return the c-value
-		misc.Warn(p.topic+".getUSDDBalance", fmt.Sprintf("action=\"%s\" reason=\"%s\"", "query USDD balance", err.Error()))
-		return p.cBalance[USDD]
+// getBalances reads the vault USDD balance and every ilk`s gem balance in one multicall,
+// a balance that cannot be read falls back to its c-value
+func (p *PSM) getBalances(ctx context.Context) map[string]*big.Int {
+	multicall := abi.NewMulticall(p.chain)
+	calls := make(map[string]*abi.Call)
+	calls[USDD] = multicall.Add(abi.NewContract(p.chain, USDD_DaiJoin, abi.MustLoad("dai_join")), "getUsddBalance")
+	for _, name := range p.ilkList {
+		calls[name] = multicall.Add(abi.NewERC20(p.chain, p.ilks[name].token).Contract, "balanceOf", p.ilks[name].gemJoin)
+	}
+	_, _ = multicall.Do(ctx)
+
+	balances := make(map[string]*big.Int)
+	for name, call := range calls {
+		result, err := call.BigInt()
+		if err != nil {
+			misc.Warn(fmt.Sprintf("%s.get%sBalance", p.topic, name),
+				fmt.Sprintf("action=\"query %s balance\" reason=\"%s\"", name, err.Error()))
+			balances[name] = p.cBalance[name]
+			continue
+		}
+		if name == USDD {
+			balances[name] = misc.ConvertDec6(result)
+		} else {
+			balances[name] = misc.ConvertDecN(result, p.ilks[name].decimal)
+		}
 	}
-	return misc.ConvertDec6(misc.ToBigInt(result))
+	return balances
 }
 
-func (p *PSM) getTokenBalance(name string) *big.Int {
-	result, err := net.Trigger(ilks[name].token, "balanceOf(address)", misc.ToEthAddr(ilks[name].gemJoin))
-	if err != nil {
-		// if we cannot get current balance, return the c-value
-		misc.Warn(fmt.Sprintf("%s.get%sBalance", p.topic, name),
-			fmt.Sprintf("action=\"query %s balance\" reason=\"%s\"", name, err.Error()))
-		return p.cBalance[name]
+// getIlkStates reads the fees and the debt of every ilk in one multicall,
+// an ilk that cannot be read falls back to its c-state
+func (p *PSM) getIlkStates(ctx context.Context) map[string]*ilkState {
+	type ilkCalls struct {
+		tin, tout, ilks *abi.Call
+	}
+	multicall := abi.NewMulticall(p.chain)
+	calls := make(map[string]*ilkCalls)
+	for _, name := range p.ilkList {
+		gem := p.ilks[name]
+		if len(gem.vat) == 0 {
+			continue
+		}
+		psm := abi.NewPSM(p.chain, gem.psm).Contract
+		calls[name] = &ilkCalls{
+			tin:  multicall.Add(psm, "tin"),
+			tout: multicall.Add(psm, "tout"),
+			ilks: multicall.Add(abi.NewVat(p.chain, gem.vat).Contract, "ilks", gem.id),
+		}
+	}
+	_, _ = multicall.Do(ctx)
+
+	states := make(map[string]*ilkState)
+	for name, c := range calls {
+		tin, err := c.tin.BigInt()
+		var tout *big.Int
+		if err == nil {
+			tout, err = c.tout.BigInt()
+		}
+		var values []*big.Int
+		if err == nil {
+			values, err = c.ilks.BigInts()
+		}
+		if err != nil {
+			misc.Warn(p.topic+".getIlkStates", fmt.Sprintf("action=\"query %s ilk state\" reason=\"%s\"", name, err.Error()))
+			states[name] = p.cStates[name]
+			continue
+		}
+		vatIlk := abi.NewVatIlk(values)
+		states[name] = &ilkState{tin: tin, tout: tout, debt: vatIlk.Debt(), line: vatIlk.Line}
 	}
-	return misc.ConvertDecN(misc.ToBigInt(result), ilks[name].decimal)
+	return states
 }
@@ -3,11 +3,14 @@ package monitor
 import (
 	"psm-monitor/abi"
 	"psm-monitor/config"
+	"psm-monitor/db"
 	"psm-monitor/misc"
 	"psm-monitor/net"
 	"psm-monitor/slack"
 
+	"context"
 	"fmt"
+	"math"
 	"math/big"
 	"math/rand"
 	"strconv"
@@ -17,21 +20,56 @@ import (
 	"github.com/robfig/cron"
 )
 
-const (
-	USDD_2Pool_Name = "USDD-2pool"
-	USDD_2Pool      = "TNTfaTpkdd4AQDeqr8SGG7tgdkdjdhbP5c"
-	TUSD_2Pool_Name = "TUSD-2pool"
-	TUSD_2Pool      = "TS8d3ZrSxiGZkqhJqMzFKHEC1pjaowFMBJ"
-)
+// maxPoolCoins bounds the on-chain probe of the coin count of a pool
+const maxPoolCoins = 8
+
+// feeAPYWindow is how far back the virtual price is compared to estimate the fee APY of LPs
+const feeAPYWindow = 24 * time.Hour
+
+// PoolRecord is a sample of the LP state of a pool, taken on every check
+type PoolRecord struct {
+	ID           uint      `gorm:"primaryKey"`
+	TrackedAt    time.Time `gorm:"index"`
+	Pool         string    `gorm:"index"`
+	VirtualPrice float64
+	LPSupply     float64
+	// Fee and AdminFee are fractions, AdminBalances is the sum of the admin fees of all coins in whole tokens
+	Fee           float64
+	AdminFee      float64
+	AdminBalances float64
+}
+
+// lpState is a snapshot of the LP side of a pool, raw values as returned by the pool
+type lpState struct {
+	// virtualPrice and supply are scaled by 1e18, fee and adminFee by 1e10
+	virtualPrice  *big.Int
+	supply        *big.Int
+	fee           *big.Int
+	adminFee      *big.Int
+	adminBalances []*big.Int
+}
+
+// poolPayout is a transfer of coin i out of the pool
+type poolPayout struct {
+	i     int
+	value *big.Int
+}
 
 type pool struct {
-	name string
-	addr string
+	name    string
+	addr    string
+	lpToken string
+	chain   net.ChainProvider
 
 	coinsAddr []string
 	coinsName []string
 	coinsDec  []uint8
 
+	// underlying coins indexed by TokenExchangeUnderlying, empty for plain pools
+	underlyingAddr []string
+	underlyingName []string
+	underlyingDec  []uint8
+
 	// check balances for this pool
 	cPoolBalances []*big.Int
 
@@ -42,127 +80,424 @@ type pool struct {
 	// stats balances for this pool
 	sPoolBalances []*big.Int
 
-	removeOneGot bool
+	// RemoveLiquidityOne names no coin, its coin is the one the pool pays coin_amount of in the same transaction,
+	// the removals and payouts of the transaction in hand wait here for each other, whichever comes first
+	oneTx       string
+	oneRemovals []*big.Int
+	onePayouts  []poolPayout
+
+	// depeg levels reached by every coin, by the depeg probe
+	depegLevels []int
+
+	// check virtual price and stats admin balances in whole tokens, nil until they are read
+	cVirtualPrice  *big.Int
+	sAdminBalances []*big.Int
 }
 
-func (p *pool) init(n int) {
+func (p *pool) init(ctx context.Context, n int) {
+	if n == 0 {
+		n = p.countCoins(ctx)
+	}
 	p.coinsAddr = make([]string, n)
 	p.coinsName = make([]string, n)
 	p.coinsDec = make([]uint8, n)
 	p.cPoolBalances = make([]*big.Int, n)
 	p.rPoolBalances = make([]*big.Int, n)
 	p.sPoolBalances = make([]*big.Int, n)
+	p.depegLevels = make([]int, n)
 
 	for i := 0; i < n; i++ {
-		p.coinsAddr[i] = abi.Coins(p.addr, uint64(i))
-		p.coinsName[i] = abi.Name(p.coinsAddr[i])
-		p.coinsDec[i] = abi.Decimals(p.coinsAddr[i])
+		p.coinsAddr[i] = abi.Coins(ctx, p.chain, p.addr, uint64(i))
+		p.coinsName[i] = abi.Name(ctx, p.chain, p.coinsAddr[i])
+		p.coinsDec[i] = abi.Decimals(ctx, p.chain, p.coinsAddr[i])
+	}
+
+	if len(p.lpToken) == 0 {
+		lpToken, err := abi.NewCurvePool(p.chain, p.addr).Token(ctx)
+		if err != nil || len(lpToken) == 0 {
+			// factory pools are their own LP token
+			lpToken = p.addr
+		}
+		p.lpToken = lpToken
+	}
+	p.initUnderlying(ctx)
+}
+
+// initUnderlying resolves the underlying coins of the pool, the underlying_coins of a lending pool,
+// or for a metapool its coins but the base pool LP token followed by the base_coins
+func (p *pool) initUnderlying(ctx context.Context) {
+	curve := abi.NewCurvePool(p.chain, p.addr)
+	var coins []string
+	for i := range p.coinsAddr {
+		coin, err := curve.UnderlyingCoins(ctx, uint64(i))
+		if err != nil || len(coin) == 0 {
+			coins = nil
+			break
+		}
+		coins = append(coins, coin)
+	}
+	if len(coins) == 0 && len(p.coinsAddr) != 0 {
+		for i := 0; i < maxPoolCoins; i++ {
+			coin, err := curve.BaseCoins(ctx, uint64(i))
+			if err != nil || len(coin) == 0 {
+				break
+			}
+			coins = append(coins, coin)
+		}
+		if len(coins) != 0 {
+			coins = append(append([]string{}, p.coinsAddr[:len(p.coinsAddr)-1]...), coins...)
+		}
+	}
+	for _, coin := range coins {
+		var (
+			name string
+			dec  uint8
+		)
+		if i := p.coinIndex(coin); i >= 0 {
+			name, dec = p.coinsName[i], p.coinsDec[i]
+		} else {
+			name, dec = abi.Name(ctx, p.chain, coin), abi.Decimals(ctx, p.chain, coin)
+		}
+		p.underlyingAddr = append(p.underlyingAddr, coin)
+		p.underlyingName = append(p.underlyingName, name)
+		p.underlyingDec = append(p.underlyingDec, dec)
+	}
+	if len(coins) != 0 {
+		misc.Info(p.name+".initUnderlying", fmt.Sprintf("action=\"resolve underlying coins\" coins=%s", strings.Join(p.underlyingName, ",")))
+	}
+}
 
-		p.cPoolBalances[i] = p.getPoolBalance(i)
+// initState seeds the check, report and stats values of the pool from its present state
+func (p *pool) initState(ctx context.Context) {
+	balances, _ := p.getState(ctx)
+	for i := range p.coinsAddr {
+		p.cPoolBalances[i] = balances[i]
 		p.rPoolBalances[i] = big.NewInt(-1)
 		p.sPoolBalances[i] = p.cPoolBalances[i]
 	}
+	if state := p.getLPState(ctx); state != nil {
+		p.cVirtualPrice = state.virtualPrice
+		p.sAdminBalances = p.toAdminBalances(state)
+	}
 }
 
-func (p *pool) getA() int64 {
-	if result, err := net.Trigger(p.addr, "A()", ""); err == nil {
-		return misc.ToBigInt(result).Int64()
+// countCoins probes coins(i) until it reverts, as curve pools expose no coin count
+func (p *pool) countCoins(ctx context.Context) int {
+	curve := abi.NewCurvePool(p.chain, p.addr)
+	for i := 0; i < maxPoolCoins; i++ {
+		if coin, err := curve.Coins(ctx, uint64(i)); err != nil || len(coin) == 0 {
+			misc.Info(p.name+".countCoins", fmt.Sprintf("action=\"probe coin count\" coins=%d", i))
+			return i
+		}
+	}
+	return maxPoolCoins
+}
+
+// coinIndex returns the index of the coin at addr, -1 if it is not a coin of the pool
+func (p *pool) coinIndex(addr string) int {
+	for i, coin := range p.coinsAddr {
+		if strings.Compare(coin, addr) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// symbolIndex returns the index of the coin with the given symbol, -1 if it is not a coin of the pool
+func (p *pool) symbolIndex(symbol string) int {
+	for i, name := range p.coinsName {
+		if strings.Compare(name, symbol) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// thresholds returns the current thresholds for coin i of the pool
+func (p *pool) thresholds(i int) config.CoinThresholdConfig {
+	sunConfig := config.Get().SUN
+	return sunConfig.Thresholds(p.addr, p.coinsName[i])
+}
+
+// getState reads the balance of every coin and the A value of the pool in one multicall,
+// a value that cannot be read falls back to its c-value or pre-value
+func (p *pool) getState(ctx context.Context) ([]*big.Int, int64) {
+	multicall := abi.NewMulticall(p.chain)
+	curve := abi.NewCurvePool(p.chain, p.addr)
+	balanceCalls := make([]*abi.Call, len(p.coinsAddr))
+	for i := range p.coinsAddr {
+		balanceCalls[i] = multicall.Add(curve.Contract, "balances", uint64(i))
+	}
+	aCall := multicall.Add(curve.Contract, "A")
+	_, _ = multicall.Do(ctx)
+
+	balances := make([]*big.Int, len(balanceCalls))
+	for i, call := range balanceCalls {
+		if res, err := call.BigInt(); err == nil {
+			balances[i] = misc.ConvertDecN(res, p.coinsDec[i])
+		} else {
+			// if we cannot get current coin pool balance, return the c-value
+			misc.Warn(p.name+".getPoolBalance", fmt.Sprintf("action=query \"%s\" pool balance in \"%s\" failed, reason=\"%s\"", p.coinsName[i], p.name, err.Error()))
+			balances[i] = p.cPoolBalances[i]
+		}
+	}
+	a := p.preA
+	if res, err := aCall.BigInt(); err == nil {
+		a = res.Int64()
 	} else {
 		// if we cannot get current pool A value, return the pre-value
 		misc.Warn(p.name+".getA", fmt.Sprintf("action=\"%s\" reason=\"%s\"", "query A value", err.Error()))
-		return p.preA
 	}
+	return balances, a
 }
 
-func (p *pool) getPoolBalance(i int) *big.Int {
-	if res, err := abi.Balances(p.addr, i); err == nil {
-		return misc.ConvertDecN(res, p.coinsDec[i])
-	} else {
-		// if we cannot get current coin pool balance, return the c-value
-		misc.Warn(p.name+".getPoolBalance", fmt.Sprintf("action=query \"%s\" pool balance in \"%s\" failed, reason=\"%s\"", p.coinsName[i], p.name, err.Error()))
-		return p.cPoolBalances[i]
+// getPrices quotes selling every coin for coin q at the trade sizes in one multicall,
+// a price is how many q one whole coin gets, a coin whose quotes cannot be read is left nil
+func (p *pool) getPrices(ctx context.Context, q int, sizes []int64) [][]float64 {
+	multicall := abi.NewMulticall(p.chain)
+	curve := abi.NewCurvePool(p.chain, p.addr)
+	calls := make([][]*abi.Call, len(p.coinsAddr))
+	for i := range p.coinsAddr {
+		if i == q {
+			continue
+		}
+		calls[i] = make([]*abi.Call, len(sizes))
+		for k, size := range sizes {
+			dx := new(big.Int).Mul(big.NewInt(size), misc.GetDec(p.coinsDec[i]))
+			calls[i][k] = multicall.Add(curve.Contract, "get_dy", i, q, dx)
+		}
+	}
+	_, _ = multicall.Do(ctx)
+
+	prices := make([][]float64, len(p.coinsAddr))
+	for i := range calls {
+		if calls[i] == nil {
+			continue
+		}
+		coinPrices := make([]float64, len(sizes))
+		for k, call := range calls[i] {
+			dy, err := call.BigInt()
+			if err != nil {
+				misc.Warn(p.name+".getPrices", fmt.Sprintf("action=\"quote %d %s\" reason=\"%s\"", sizes[k], p.coinsName[i], err.Error()))
+				coinPrices = nil
+				break
+			}
+			amount, _ := new(big.Rat).SetFrac(dy, misc.GetDec(p.coinsDec[q])).Float64()
+			coinPrices[k] = amount / float64(sizes[k])
+		}
+		prices[i] = coinPrices
+	}
+	return prices
+}
+
+// formatPrice formats the price of a coin at the smallest size, and the price impact of the larger sizes
+func formatPrice(prices []float64, sizes []int64, quote string) string {
+	str := fmt.Sprintf("price - `%.4f` %s at `%s`", prices[0], quote, misc.ToReadableDec(big.NewInt(sizes[0])))
+	if len(prices) > 1 {
+		impacts := make([]string, 0, len(prices)-1)
+		for k := 1; k < len(prices); k++ {
+			impacts = append(impacts, fmt.Sprintf("`%.2f%%` at `%s`", (prices[0]-prices[k])/prices[0]*100, misc.ToReadableDec(big.NewInt(sizes[k]))))
+		}
+		str += ", impact - " + strings.Join(impacts, ", ")
+	}
+	return str
+}
+
+// formatPrices formats the probed price of every coin of the pool for the report, empty when there is no probe
+func (p *pool) formatPrices(ctx context.Context) string {
+	sunConfig := config.Get().SUN
+	q := p.symbolIndex(sunConfig.Quote)
+	if len(sunConfig.ProbeSizes) == 0 || q < 0 {
+		return ""
+	}
+	str := ""
+	for i, prices := range p.getPrices(ctx, q, sunConfig.ProbeSizes) {
+		if prices != nil {
+			str += fmt.Sprintf("\n`%s` %s", p.coinsName[i], formatPrice(prices, sunConfig.ProbeSizes, sunConfig.Quote))
+		}
+	}
+	return str
+}
+
+// depegLevel returns how many levels the deviation reached, a reached level is only left
+// once the deviation falls hysteresis below it, so a price hovering at a boundary alerts once
+func depegLevel(deviation float64, pre int, levels []float64, hysteresis float64) int {
+	level := 0
+	for level < len(levels) && deviation >= levels[level] {
+		level++
+	}
+	if level >= pre {
+		return level
+	}
+	held := 0
+	for held < len(levels) && deviation >= levels[held]-hysteresis {
+		held++
+	}
+	if held < pre {
+		return held
+	}
+	return pre
+}
+
+// getLPState reads the virtual price, LP supply, fees and admin balances of the pool in one multicall, nil if any cannot be read
+func (p *pool) getLPState(ctx context.Context) *lpState {
+	multicall := abi.NewMulticall(p.chain)
+	curve := abi.NewCurvePool(p.chain, p.addr)
+	virtualPriceCall := multicall.Add(curve.Contract, "get_virtual_price")
+	supplyCall := multicall.Add(abi.NewERC20(p.chain, p.lpToken).Contract, "totalSupply")
+	feeCall := multicall.Add(curve.Contract, "fee")
+	adminFeeCall := multicall.Add(curve.Contract, "admin_fee")
+	adminBalanceCalls := make([]*abi.Call, len(p.coinsAddr))
+	for i := range p.coinsAddr {
+		adminBalanceCalls[i] = multicall.Add(curve.Contract, "admin_balances", uint64(i))
+	}
+	_, _ = multicall.Do(ctx)
+
+	values := make([]*big.Int, 0, 4+len(adminBalanceCalls))
+	for _, call := range append([]*abi.Call{virtualPriceCall, supplyCall, feeCall, adminFeeCall}, adminBalanceCalls...) {
+		value, err := call.BigInt()
+		if err != nil {
+			misc.Warn(p.name+".getLPState", fmt.Sprintf("action=\"query LP state of %s\" reason=\"%s\"", p.name, err.Error()))
+			return nil
+		}
+		values = append(values, value)
+	}
+	return &lpState{
+		virtualPrice:  values[0],
+		supply:        values[1],
+		fee:           values[2],
+		adminFee:      values[3],
+		adminBalances: values[4:],
+	}
+}
+
+// toAdminBalances converts the admin balances of the state to whole tokens
+func (p *pool) toAdminBalances(state *lpState) []*big.Int {
+	balances := make([]*big.Int, len(state.adminBalances))
+	for i, balance := range state.adminBalances {
+		balances[i] = misc.ConvertDecN(new(big.Int).Set(balance), p.coinsDec[i])
+	}
+	return balances
+}
+
+// record saves the LP state of the pool to monitor.db
+func (p *pool) record(state *lpState, adminBalances []*big.Int, now time.Time) {
+	adminTotal := big.NewInt(0)
+	for _, balance := range adminBalances {
+		adminTotal.Add(adminTotal, balance)
+	}
+	record := PoolRecord{
+		TrackedAt:     now,
+		Pool:          p.addr,
+		VirtualPrice:  toFloat(state.virtualPrice, misc.GetDec(18)),
+		LPSupply:      toFloat(state.supply, misc.GetDec(18)),
+		Fee:           toFloat(state.fee, misc.GetDec(10)),
+		AdminFee:      toFloat(state.adminFee, misc.GetDec(10)),
+		AdminBalances: toFloat(adminTotal, big.NewInt(1)),
+	}
+	if err := db.Get().Create(&record).Error; err != nil {
+		misc.Warn(p.name+".record", fmt.Sprintf("action=\"save LP state of %s\" reason=\"%s\"", p.name, err.Error()))
 	}
 }
 
+// feeAPY estimates the yearly return of LPs from the growth of the virtual price since the record
+// feeAPYWindow ago, or the oldest one when there is no such record yet, false without an hour of history
+func (p *pool) feeAPY(virtualPrice *big.Int, now time.Time) (float64, bool) {
+	var pre PoolRecord
+	found := db.Get().Where("pool = ? AND tracked_at <= ?", p.addr, now.Add(-feeAPYWindow)).
+		Order("tracked_at DESC").Limit(1).Find(&pre).RowsAffected > 0
+	if !found {
+		found = db.Get().Where("pool = ?", p.addr).Order("tracked_at").Limit(1).Find(&pre).RowsAffected > 0
+	}
+	elapsed := now.Sub(pre.TrackedAt)
+	if !found || elapsed < time.Hour || pre.VirtualPrice <= 0 {
+		return 0, false
+	}
+	growth := toFloat(virtualPrice, misc.GetDec(18)) / pre.VirtualPrice
+	return (math.Pow(growth, float64(365*24*time.Hour)/float64(elapsed)) - 1) * 100, true
+}
+
+func toFloat(value, scale *big.Int) float64 {
+	f, _ := new(big.Rat).SetFrac(value, scale).Float64()
+	return f
+}
+
 type SUN struct {
 	topic string
+	chain net.ChainProvider
 
 	// all tracked pools
 	pools map[string]*pool
 	sTime time.Time
 }
 
-type oneCoinTx struct {
-	TriggerInfo struct {
-		Parameter map[string]string
-	} `json:"trigger_info"`
-}
-
-func StartSUN(c *cron.Cron, concerned map[string]func(event *net.Event)) {
-	sun := &SUN{topic: ":sunio: [SUN]", sTime: time.Now()}
+// StartSUN starts the SUN pool monitor, a nil c starts it for replay with the event handlers only,
+// the pool states are neither read nor reported
+func StartSUN(ctx context.Context, c *cron.Cron, chain net.ChainProvider, concerned map[string]func(ctx context.Context, event *net.Event)) {
+	sun := &SUN{topic: ":sunio: [SUN]", chain: chain, sTime: time.Now()}
 
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */10 * * * ?", misc.WrapLog(sun.check))
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(sun.report))
-	_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(sun.stats))
-
-	sun.pools = make(map[string]*pool)
-	sun.pools[USDD_2Pool_Name] = &pool{
-		name: USDD_2Pool_Name,
-		addr: USDD_2Pool,
+	if c != nil {
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */10 * * * ?", misc.WrapLog(ctx, sun.check))
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(ctx, sun.report))
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(ctx, sun.stats))
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" */1 * * * ?", misc.WrapLog(ctx, sun.probe))
 	}
-	sun.pools[USDD_2Pool_Name].init(2)
-	sun.pools[TUSD_2Pool_Name] = &pool{
-		name: TUSD_2Pool_Name,
-		addr: TUSD_2Pool,
-	}
-	sun.pools[TUSD_2Pool_Name].init(2)
 
-	for _, v := range sun.pools {
-		concerned[v.addr] = func(event *net.Event) {
-			sun.handleSwapSwapPoolEvent(event, v)
+	_ = db.Get().AutoMigrate(&PoolRecord{})
+	sun.pools = make(map[string]*pool)
+	for _, poolConfig := range config.Get().SUN.Pools {
+		v := &pool{
+			name:    poolConfig.Name,
+			addr:    poolConfig.Address,
+			lpToken: poolConfig.LPToken,
+			chain:   chain,
 		}
-		concerned[v.coinsAddr[0]] = func(event *net.Event) {
-			sun.handleSwapSwapPoolEvent(event, v)
+		if len(v.name) == 0 {
+			v.name = v.addr
 		}
-		concerned[v.coinsAddr[1]] = func(event *net.Event) {
-			sun.handleSwapSwapPoolEvent(event, v)
+		v.init(ctx, poolConfig.Coins)
+		sun.pools[v.name] = v
+
+		handler := func(ctx context.Context, event *net.Event) {
+			sun.handleSwapSwapPoolEvent(ctx, event, v)
+		}
+		// coins like USDT are shared by several pools, so every pool subscribes its own handler
+		subscribe(concerned, v.addr, handler)
+		for _, coin := range v.coinsAddr {
+			subscribe(concerned, coin, handler)
 		}
 	}
 
-	sun.init()
+	if c != nil {
+		sun.init(ctx)
+	}
 }
 
-func (s *SUN) handleSwapSwapPoolEvent(event *net.Event, pool *pool) {
+func (s *SUN) handleSwapSwapPoolEvent(ctx context.Context, event *net.Event, pool *pool) {
 	switch event.EventName {
-	case "TokenExchange":
-		var (
-			boughtToken string
-			soldToken   string
-		)
-		boughtAmount, _ := new(big.Int).SetString(event.Result["tokens_bought"], 10)
-		soldAmount, _ := new(big.Int).SetString(event.Result["tokens_sold"], 10)
-		if strings.Compare(event.Result["sold_id"], "0") == 0 {
-			// swap coin0 => coin1
-			boughtToken = pool.coinsName[1]
-			boughtAmount = misc.ConvertDecN(boughtAmount, pool.coinsDec[1])
-			soldToken = pool.coinsName[0]
-			soldAmount = misc.ConvertDecN(soldAmount, pool.coinsDec[0])
-		} else {
-			// swap coin1 => coin0
-			boughtToken = pool.coinsName[0]
-			boughtAmount = misc.ConvertDecN(boughtAmount, pool.coinsDec[0])
-			soldToken = pool.coinsName[1]
-			soldAmount = misc.ConvertDecN(soldAmount, pool.coinsDec[1])
+	case "TokenExchange", "TokenExchangeUnderlying":
+		// the ids of TokenExchangeUnderlying index the underlying coins
+		coinsName, coinsDec := pool.coinsName, pool.coinsDec
+		if event.EventName == "TokenExchangeUnderlying" {
+			coinsName, coinsDec = pool.underlyingName, pool.underlyingDec
 		}
+		soldID, boughtID := int(event.BigInt("sold_id").Int64()), int(event.BigInt("bought_id").Int64())
+		if soldID < 0 || soldID >= len(coinsName) || boughtID < 0 || boughtID >= len(coinsName) {
+			misc.Warn(pool.name+".handleTokenExchange", fmt.Sprintf("action=\"map coin index\" reason=\"sold_id %d bought_id %d out of %d coins\" event=%s tx=%s", soldID, boughtID, len(coinsName), event.EventName, event.TransactionHash))
+			return
+		}
+		boughtToken, soldToken := coinsName[boughtID], coinsName[soldID]
+		boughtAmount := misc.ConvertDecN(event.BigInt("tokens_bought"), coinsDec[boughtID])
+		soldAmount := misc.ConvertDecN(event.BigInt("tokens_sold"), coinsDec[soldID])
 		diff := big.NewInt(0)
 		diff = diff.Sub(soldAmount, boughtAmount)
-		threshold := big.NewInt(config.Get().SUN.SwapThreshold)
+		threshold := big.NewInt(config.Get().SUN.Thresholds(pool.addr, boughtToken).SwapThreshold)
 		if boughtAmount.Cmp(threshold) > 0 {
 			msg := appendWarningIfNeeded(fmt.Sprintf("Large %s, %s => %s, %s, ",
 				event.EventName,
 				misc.FormatTokenAmt(soldToken, soldAmount, false),
 				misc.FormatTokenAmt(boughtToken, boughtAmount, false),
-				misc.FormatUser(net.GetTxFrom(event.TransactionHash))), boughtToken)
+				misc.FormatUser(getTxFrom(ctx, s.chain, event.TransactionHash))), boughtToken)
 			if diff.Sign() > 0 {
 				msg += fmt.Sprintf("lose %s, slip - `%.3f%%`, ",
 					misc.FormatTokenAmt(boughtToken, diff, false),
@@ -173,71 +508,103 @@ func (s *SUN) handleSwapSwapPoolEvent(event *net.Event, pool *pool) {
 					float64(diff.Uint64())/float64(soldAmount.Uint64())*100)
 			}
 			msg += misc.FormatTxUrl(event.TransactionHash)
-			slack.SendMsg(s.topic, msg+" in `"+pool.name+"`")
+			slack.SendMsg(ctx, s.topic, msg+" in `"+pool.name+"`")
 		}
 	case "AddLiquidity":
-		s.reportLiquidityOperation(event, pool, false)
+		s.reportLiquidityOperation(ctx, event, pool, false)
 	case "RemoveLiquidity", "RemoveLiquidityImbalance":
-		s.reportLiquidityOperation(event, pool, true)
-	case "RemoveLiquidityOne":
-		// For RemoveLiquidityOne, there is no way to judge which coin is removed
-		// So we judge coin by the next Transfer event
-		pool.removeOneGot = true
-	case "Transfer":
-		if pool.removeOneGot {
-			pool.removeOneGot = false
-			tokenAmount, _ := new(big.Int).SetString(event.Result["value"], 10)
-			threshold := big.NewInt(config.Get().SUN.LiquidityThreshold)
-			tokenName := ""
-			if strings.Compare(event.Address, pool.coinsAddr[0]) == 0 {
-				// remove coin0
-				tokenAmount = misc.ConvertDecN(tokenAmount, pool.coinsDec[0])
-				tokenName = pool.coinsName[0]
-			} else {
-				// remove coin1
-				tokenAmount = misc.ConvertDecN(tokenAmount, pool.coinsDec[1])
-				tokenName = pool.coinsName[1]
-			}
-			if tokenAmount.Cmp(threshold) >= 0 {
-				msg := appendWarningIfNeeded(fmt.Sprintf("Large RemoveLiquidityOne, %s, %s, %s",
-					misc.FormatTokenAmt(tokenName, tokenAmount.Neg(tokenAmount), true),
-					misc.FormatUser(net.GetTxFrom(event.TransactionHash)),
-					misc.FormatTxUrl(event.TransactionHash)), tokenName)
-				slack.SendMsg(s.topic, msg+" in `"+pool.name+"`")
-			}
-		}
+		s.reportLiquidityOperation(ctx, event, pool, true)
+	case "RemoveLiquidityOne", "Transfer":
+		s.matchRemoveLiquidityOne(ctx, event, pool)
 	case "RampA":
-		oldA, _ := new(big.Int).SetString(event.Result["old_A"], 10)
-		newA, _ := new(big.Int).SetString(event.Result["new_A"], 10)
-		slack.SendMsg(s.topic, "Ramp A from  `%d` => `%d`, %s in `%s`",
+		oldA, newA := event.BigInt("old_A"), event.BigInt("new_A")
+		slack.SendMsg(ctx, s.topic, "Ramp A from  `%d` => `%d`, %s in `%s`",
 			oldA, newA, misc.FormatTxUrl(event.TransactionHash), pool.name)
 	}
 }
 
-func (s *SUN) reportLiquidityOperation(event *net.Event, pool *pool, isRemove bool) {
-	tokenAmounts := strings.Split(event.Result["token_amounts"], "\n")
-	changedLiquidityOfCoin0, _ := new(big.Int).SetString(tokenAmounts[0], 10)
-	changedLiquidityOfCoin0 = misc.ConvertDecN(changedLiquidityOfCoin0, pool.coinsDec[0])
-	if isRemove {
-		changedLiquidityOfCoin0 = changedLiquidityOfCoin0.Neg(changedLiquidityOfCoin0)
+// matchRemoveLiquidityOne pairs a RemoveLiquidityOne with the pool transfer paying out its coin_amount in the same transaction,
+// the transfer is emitted before the event by the pool, but both orders are matched
+func (s *SUN) matchRemoveLiquidityOne(ctx context.Context, event *net.Event, pool *pool) {
+	if event.TransactionHash != pool.oneTx {
+		// the events of a transaction are handled together, so those of the previous one never match any more
+		pool.oneTx, pool.oneRemovals, pool.onePayouts = event.TransactionHash, nil, nil
 	}
-	changedLiquidityOfCoin1, _ := new(big.Int).SetString(tokenAmounts[1], 10)
-	changedLiquidityOfCoin1 = misc.ConvertDecN(changedLiquidityOfCoin1, pool.coinsDec[1])
-	if isRemove {
-		changedLiquidityOfCoin1 = changedLiquidityOfCoin1.Neg(changedLiquidityOfCoin1)
+	if event.EventName == "RemoveLiquidityOne" {
+		amount := event.BigInt("coin_amount")
+		for k, payout := range pool.onePayouts {
+			if payout.value.Cmp(amount) == 0 {
+				pool.onePayouts = append(pool.onePayouts[:k], pool.onePayouts[k+1:]...)
+				s.reportRemoveLiquidityOne(ctx, event, pool, payout.i, amount)
+				return
+			}
+		}
+		pool.oneRemovals = append(pool.oneRemovals, amount)
+		return
+	}
+
+	i := pool.coinIndex(event.Address)
+	if i < 0 || strings.Compare(event.Addr("from"), pool.addr) != 0 {
+		return
 	}
-	threshold := big.NewInt(config.Get().SUN.LiquidityThreshold)
-	if changedLiquidityOfCoin0.CmpAbs(threshold) >= 0 || changedLiquidityOfCoin1.CmpAbs(threshold) >= 0 {
-		msg := fmt.Sprintf("Large %s, %s, %s, %s, %s",
+	value := event.BigInt("value")
+	for k, amount := range pool.oneRemovals {
+		if amount.Cmp(value) == 0 {
+			pool.oneRemovals = append(pool.oneRemovals[:k], pool.oneRemovals[k+1:]...)
+			s.reportRemoveLiquidityOne(ctx, event, pool, i, amount)
+			return
+		}
+	}
+	pool.onePayouts = append(pool.onePayouts, poolPayout{i: i, value: value})
+}
+
+func (s *SUN) reportRemoveLiquidityOne(ctx context.Context, event *net.Event, pool *pool, i int, amount *big.Int) {
+	tokenAmount := misc.ConvertDecN(new(big.Int).Set(amount), pool.coinsDec[i])
+	tokenName := pool.coinsName[i]
+	threshold := big.NewInt(pool.thresholds(i).LiquidityThreshold)
+	if tokenAmount.Cmp(threshold) >= 0 {
+		msg := appendWarningIfNeeded(fmt.Sprintf("Large RemoveLiquidityOne, %s, %s, %s",
+			misc.FormatTokenAmt(tokenName, tokenAmount.Neg(tokenAmount), true),
+			misc.FormatUser(getTxFrom(ctx, s.chain, event.TransactionHash)),
+			misc.FormatTxUrl(event.TransactionHash)), tokenName)
+		slack.SendMsg(ctx, s.topic, msg+" in `"+pool.name+"`")
+	}
+}
+
+func (s *SUN) reportLiquidityOperation(ctx context.Context, event *net.Event, pool *pool, isRemove bool) {
+	tokenAmounts := event.BigInts("token_amounts")
+	if len(tokenAmounts) < len(pool.coinsAddr) {
+		misc.Warn(pool.name+".reportLiquidityOperation", fmt.Sprintf("action=\"parse token_amounts\" reason=\"got %d amounts\" tx=%s", len(tokenAmounts), event.TransactionHash))
+		return
+	}
+	var (
+		isLarge     bool
+		usdtRemoved bool
+		amountsStr  string
+	)
+	for i := range pool.coinsAddr {
+		changedLiquidity := misc.ConvertDecN(tokenAmounts[i], pool.coinsDec[i])
+		if isRemove {
+			changedLiquidity = changedLiquidity.Neg(changedLiquidity)
+		}
+		if changedLiquidity.CmpAbs(big.NewInt(pool.thresholds(i).LiquidityThreshold)) >= 0 {
+			isLarge = true
+		}
+		if changedLiquidity.Sign() < 0 && strings.Compare(pool.coinsName[i], "USDT") == 0 {
+			usdtRemoved = true
+		}
+		amountsStr += misc.FormatTokenAmt(pool.coinsName[i], changedLiquidity, true) + ", "
+	}
+	if isLarge {
+		msg := fmt.Sprintf("Large %s, %s%s, %s",
 			event.EventName,
-			misc.FormatTokenAmt(pool.coinsName[0], changedLiquidityOfCoin0, true),
-			misc.FormatTokenAmt(pool.coinsName[1], changedLiquidityOfCoin1, true),
-			misc.FormatUser(net.GetTxFrom(event.TransactionHash)),
+			amountsStr,
+			misc.FormatUser(getTxFrom(ctx, s.chain, event.TransactionHash)),
 			misc.FormatTxUrl(event.TransactionHash))
-		if changedLiquidityOfCoin0.Cmp(big.NewInt(0)) < 0 && strings.Compare(pool.coinsName[0], "USDT") == 0 || changedLiquidityOfCoin1.Cmp(big.NewInt(0)) < 0 && strings.Compare(pool.coinsName[1], "USDT") == 0 {
+		if usdtRemoved {
 			msg = appendWarningIfNeeded(msg, "USDT")
 		}
-		slack.SendMsg(s.topic, msg+" in `"+pool.name+"`")
+		slack.SendMsg(ctx, s.topic, msg+" in `"+pool.name+"`")
 	}
 }
 
@@ -249,70 +616,181 @@ func appendWarningIfNeeded(msg, tokenName string) string {
 	return msg
 }
 
-func (s *SUN) init() {
-	s.report()
+func (s *SUN) init(ctx context.Context) {
+	for _, v := range s.pools {
+		v.initState(ctx)
+	}
+	s.report(ctx)
 }
 
-func (s *SUN) check() {
+func (s *SUN) check(ctx context.Context) {
 	for _, v := range s.pools {
-		coin0PoolBalance, coin1PoolBalance := v.getPoolBalance(0), v.getPoolBalance(1)
-		diffCoin0 := big.NewInt(0)
-		diffCoin0 = diffCoin0.Sub(coin0PoolBalance, v.cPoolBalances[0])
-		diffCoin1 := big.NewInt(0)
-		diffCoin1 = diffCoin1.Sub(coin1PoolBalance, v.cPoolBalances[1])
-		reportThreshold := big.NewInt(config.Get().SUN.ReportThreshold)
-		if diffCoin0.CmpAbs(reportThreshold) >= 0 || diffCoin1.CmpAbs(reportThreshold) >= 0 {
-			slack.SendMsg(s.topic, "Large pool balance change in last `10min`, %s, %s in `%s`",
-				misc.FormatTokenAmt(v.coinsName[0], diffCoin0, true),
-				misc.FormatTokenAmt(v.coinsName[1], diffCoin1, true),
+		balances, _ := v.getState(ctx)
+		isLarge, diffsStr := false, make([]string, len(balances))
+		for i, balance := range balances {
+			diff := big.NewInt(0)
+			diff = diff.Sub(balance, v.cPoolBalances[i])
+			if diff.CmpAbs(big.NewInt(v.thresholds(i).ReportThreshold)) >= 0 {
+				isLarge = true
+			}
+			diffsStr[i] = misc.FormatTokenAmt(v.coinsName[i], diff, true)
+		}
+		if isLarge {
+			slack.SendMsg(ctx, s.topic, "Large pool balance change in last `10min`, %s in `%s`",
+				strings.Join(diffsStr, ", "),
 				v.name)
 		}
-		v.cPoolBalances[0], v.cPoolBalances[1] = coin0PoolBalance, coin1PoolBalance
+		v.cPoolBalances = balances
+		s.checkLP(ctx, v)
 	}
 }
 
-func (s *SUN) report() {
+// checkLP records the LP state of the pool, and raises a critical alert when the virtual price drops beyond the tolerance,
+// as it only grows with fees and a drop points to an exploit or an accounting bug.
+// The check value is the highest virtual price since the last alert, so that tolerated drops do not add up unnoticed.
+func (s *SUN) checkLP(ctx context.Context, v *pool) {
+	state := v.getLPState(ctx)
+	if state == nil {
+		return
+	}
+	v.record(state, v.toAdminBalances(state), time.Now())
+	if v.cVirtualPrice == nil || v.cVirtualPrice.Sign() == 0 || state.virtualPrice.Cmp(v.cVirtualPrice) > 0 {
+		v.cVirtualPrice = state.virtualPrice
+		return
+	}
+	dropBps := toFloat(new(big.Int).Sub(v.cVirtualPrice, state.virtualPrice), v.cVirtualPrice) * 10_000
+	if dropBps > config.Get().SUN.VirtualPriceTolerance {
+		slack.SendMsg(ctx, s.topic, ":rotating_light: Virtual price dropped, `%.10f` => `%.10f` (`-%.2f` bps), LP supply - %s in `%s`",
+			toFloat(v.cVirtualPrice, misc.GetDec(18)), toFloat(state.virtualPrice, misc.GetDec(18)), dropBps,
+			misc.FormatTokenAmt("LP", misc.ConvertDecN(new(big.Int).Set(state.supply), 18), false),
+			v.name)
+		v.cVirtualPrice = state.virtualPrice
+	}
+}
+
+// probe prices the coins of every pool from get_dy quotes, and alerts when the depeg level of a coin changes
+func (s *SUN) probe(ctx context.Context) {
+	sunConfig := config.Get().SUN
+	if len(sunConfig.ProbeSizes) == 0 {
+		return
+	}
 	for _, v := range s.pools {
-		coin0PoolBalance, coin1PoolBalance, curA := v.getPoolBalance(0), v.getPoolBalance(1), v.getA()
-		coin0Float64 := float64(coin0PoolBalance.Uint64())
-		coin1Float64 := float64(coin1PoolBalance.Uint64())
-		totalFloat64 := coin0Float64 + coin1Float64
-		var (
-			coin0Ratio float64
-			coin1Ratio float64
-			format     string
-		)
-		if coin0PoolBalance.Cmp(coin1PoolBalance) > 0 {
-			coin0Ratio = coin0Float64 / coin1Float64
-			coin1Ratio = 1.0
-			format = "`%.3f%%` : `%.3f%%` :curly_loop: `%.3f` : `%.0f`"
-		} else {
-			coin0Ratio = 1.0
-			coin1Ratio = coin1Float64 / coin0Float64
-			format = "`%.3f%%` : `%.3f%%` :curly_loop: `%.0f` : `%.3f`"
+		q := v.symbolIndex(sunConfig.Quote)
+		if q < 0 {
+			continue
 		}
-		slack.SendMsg(s.topic, "State Report, %s, %s, A - `%d`, Ratio - "+format+" in `%s`",
-			misc.FormatTokenAmt(v.coinsName[0], coin0PoolBalance, false),
-			misc.FormatTokenAmt(v.coinsName[1], coin1PoolBalance, false),
+		for i, prices := range v.getPrices(ctx, q, sunConfig.ProbeSizes) {
+			if prices == nil {
+				continue
+			}
+			deviation := math.Abs(1-prices[0]) * 100
+			level, pre := depegLevel(deviation, v.depegLevels[i], sunConfig.DepegLevels, sunConfig.DepegHysteresis), v.depegLevels[i]
+			v.depegLevels[i] = level
+			priceStr := formatPrice(prices, sunConfig.ProbeSizes, sunConfig.Quote)
+			switch {
+			case level > pre:
+				emoji := ":warning:"
+				if level == len(sunConfig.DepegLevels) {
+					emoji = ":rotating_light:"
+				}
+				slack.SendMsg(ctx, s.topic, "%s Depeg of `%s` reached `%g%%`, deviation - `%.2f%%`, %s in `%s`",
+					emoji, v.coinsName[i], sunConfig.DepegLevels[level-1], deviation, priceStr, v.name)
+			case level < pre && level == 0:
+				slack.SendMsg(ctx, s.topic, ":white_check_mark: Depeg of `%s` recovered, deviation - `%.2f%%`, %s in `%s`",
+					v.coinsName[i], deviation, priceStr, v.name)
+			case level < pre && level < len(sunConfig.DepegLevels):
+				slack.SendMsg(ctx, s.topic, "Depeg of `%s` eased below `%g%%`, deviation - `%.2f%%`, %s in `%s`",
+					v.coinsName[i], sunConfig.DepegLevels[level], deviation, priceStr, v.name)
+			}
+		}
+	}
+}
+
+func (s *SUN) report(ctx context.Context) {
+	for _, v := range s.pools {
+		balances, curA := v.getState(ctx)
+		slack.SendMsg(ctx, s.topic, "State Report, %s, A - `%d`, Ratio - %s in `%s`%s",
+			v.formatBalances(balances),
 			curA,
-			coin0Float64*100/totalFloat64,
-			coin1Float64*100/totalFloat64,
-			coin0Ratio,
-			coin1Ratio,
-			v.name)
-		v.rPoolBalances[0], v.rPoolBalances[0], v.preA = coin0PoolBalance, coin1PoolBalance, curA
+			formatRatio(balances),
+			v.name,
+			v.formatPrices(ctx))
+		v.rPoolBalances, v.preA = balances, curA
 	}
 }
 
-func (s *SUN) stats() {
+func (s *SUN) stats(ctx context.Context) {
+	now := time.Now()
 	for _, v := range s.pools {
-		coin0PoolBalance, coin1PoolBalance, now := v.getPoolBalance(0), v.getPoolBalance(1), time.Now()
-		slack.SendMsg(s.topic, "Stats Report, from `%s` ~ `%s`, %s, %s in `%s`",
+		balances, _ := v.getState(ctx)
+		diffsStr := make([]string, len(balances))
+		for i, balance := range balances {
+			diffsStr[i] = misc.FormatTokenAmt(v.coinsName[i], new(big.Int).Sub(balance, v.sPoolBalances[i]), true)
+		}
+		slack.SendMsg(ctx, s.topic, "Stats Report, from `%s` ~ `%s`, %s%s in `%s`",
 			s.sTime.Format("15:04"), now.Format("15:04"),
-			misc.FormatTokenAmt(v.coinsName[0], v.sPoolBalances[0].Sub(coin0PoolBalance, v.sPoolBalances[0]), true),
-			misc.FormatTokenAmt(v.coinsName[1], v.sPoolBalances[1].Sub(coin1PoolBalance, v.sPoolBalances[1]), true),
+			strings.Join(diffsStr, ", "),
+			v.formatLPStats(ctx, now),
 			v.name)
-		v.sPoolBalances[0], v.sPoolBalances[1] = coin0PoolBalance, coin1PoolBalance
+		v.sPoolBalances = balances
+	}
+	s.sTime = now
+}
+
+// formatLPStats formats the fee APY of LPs, the fees and the admin fees accrued since the last stats
+func (p *pool) formatLPStats(ctx context.Context, now time.Time) string {
+	state := p.getLPState(ctx)
+	if state == nil {
+		return ""
+	}
+	apyStr := "`n/a`"
+	if apy, ok := p.feeAPY(state.virtualPrice, now); ok {
+		apyStr = fmt.Sprintf("`%.2f%%`", apy)
+	}
+	adminBalances := p.toAdminBalances(state)
+	accruedStr := make([]string, len(adminBalances))
+	for i, balance := range adminBalances {
+		accrued := new(big.Int).Set(balance)
+		if p.sAdminBalances != nil {
+			accrued.Sub(accrued, p.sAdminBalances[i])
+		}
+		accruedStr[i] = misc.FormatTokenAmt(p.coinsName[i], accrued, true)
+	}
+	p.sAdminBalances = adminBalances
+	return fmt.Sprintf(", LP fee APY - %s, fee - `%.4f%%`, admin fee - `%.2f%%`, admin fees accrued %s",
+		apyStr, toFloat(state.fee, misc.GetDec(8)), toFloat(state.adminFee, misc.GetDec(8)), strings.Join(accruedStr, ", "))
+}
+
+func (p *pool) formatBalances(balances []*big.Int) string {
+	balancesStr := make([]string, len(balances))
+	for i, balance := range balances {
+		balancesStr[i] = misc.FormatTokenAmt(p.coinsName[i], balance, false)
+	}
+	return strings.Join(balancesStr, ", ")
+}
+
+// formatRatio formats the share of every coin in the pool, then every balance relative to the smallest one
+func formatRatio(balances []*big.Int) string {
+	var (
+		total    float64
+		smallest = -1
+		floats   = make([]float64, len(balances))
+	)
+	for i, balance := range balances {
+		floats[i] = float64(balance.Uint64())
+		total += floats[i]
+		if smallest < 0 || floats[i] < floats[smallest] {
+			smallest = i
+		}
+	}
+	shares, ratios := make([]string, len(floats)), make([]string, len(floats))
+	for i, f := range floats {
+		shares[i] = fmt.Sprintf("`%.3f%%`", f*100/total)
+		if i == smallest {
+			ratios[i] = "`1`"
+		} else {
+			ratios[i] = fmt.Sprintf("`%.3f`", f/floats[smallest])
+		}
 	}
-	s.sTime = time.Now()
+	return strings.Join(shares, " : ") + " :curly_loop: " + strings.Join(ratios, " : ")
 }
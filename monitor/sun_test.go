@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	ethabi "github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/status-im/keycard-go/hexutils"
+	"psm-monitor/abi"
+	"psm-monitor/misc"
+	"psm-monitor/net"
+	"psm-monitor/slack"
+)
+
+// fakeChain answers the transaction queries of the handlers
+type fakeChain struct {
+	net.ChainProvider
+}
+
+func (f *fakeChain) GetTransaction(_ context.Context, id string) (*net.Transaction, error) {
+	return &net.Transaction{Hash: id, From: "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t"}, nil
+}
+
+// decodeEvent builds the event of a raw log of contract, the way the full node event source does
+func decodeEvent(t *testing.T, event ethabi.Event, contract, tx string, topics []string, values ...interface{}) *net.Event {
+	data, err := event.Inputs.NonIndexed().Pack(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, signature, result, ok := abi.DecodeLog(&net.Log{
+		Topics: append([]string{event.ID.Hex()[2:]}, topics...),
+		Data:   hexutils.BytesToHex(data),
+	})
+	if !ok {
+		t.Fatalf("DecodeLog(%s) fails", event.Name)
+	}
+	return &net.Event{Address: contract, EventName: name, Event: signature, TransactionHash: tx, Result: result}
+}
+
+func TestRemoveLiquidityOne(t *testing.T) {
+	const (
+		usdd    = "TPYmHEhy5n8TCEfYGqW2rPxsghSfzghPDn"
+		usdt    = "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t"
+		poolHex = "000000000000000000000000a614f803b6fd780986a42c78ec9c7f77e6ded13d"
+		userHex = "0000000000000000000000004c5aa00be8a4a0da9aa0b08e1e10d3e49b6d1d9f"
+	)
+	poolAddr := misc.ToTronAddr("0x" + poolHex[24:])
+	var out bytes.Buffer
+	slack.SetOutput(&out)
+	defer slack.SetOutput(nil)
+
+	sun := &SUN{topic: "[SUN]", chain: &fakeChain{}}
+	v := &pool{
+		name:      "USDD-2pool",
+		addr:      poolAddr,
+		coinsAddr: []string{usdd, usdt},
+		coinsName: []string{"USDD", "USDT"},
+		coinsDec:  []uint8{18, 6},
+	}
+	transfer := abi.MustLoad("erc20").Events["Transfer"]
+	removeOne := abi.MustLoad("curve_pool").Events["RemoveLiquidityOne"]
+	exchange := abi.MustLoad("curve_pool").Events["TokenExchange"]
+	removed := new(big.Int).Mul(big.NewInt(2_000_000), misc.GetDec(6))
+	swapped := new(big.Int).Mul(big.NewInt(3_000_000), misc.GetDec(18))
+	events := []*net.Event{
+		// remove_liquidity_one_coin pays out USDT before it emits RemoveLiquidityOne
+		decodeEvent(t, transfer, usdt, "aa", []string{poolHex, userHex}, removed),
+		decodeEvent(t, removeOne, poolAddr, "aa", []string{userHex}, big.NewInt(1), removed),
+		// a swap paying out USDD in the next transaction is no removal
+		decodeEvent(t, exchange, poolAddr, "bb", []string{userHex}, big.NewInt(1), big.NewInt(3_000_000), big.NewInt(0), swapped),
+		decodeEvent(t, transfer, usdd, "bb", []string{poolHex, userHex}, swapped),
+	}
+	for _, event := range events {
+		sun.handleSwapSwapPoolEvent(context.Background(), event, v)
+	}
+
+	var removals []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "RemoveLiquidityOne") {
+			removals = append(removals, line)
+		}
+	}
+	if len(removals) != 1 || !strings.Contains(removals[0], misc.FormatTokenAmt("USDT", new(big.Int).Neg(big.NewInt(2_000_000)), true)) {
+		t.Errorf("RemoveLiquidityOne reports = %q", removals)
+	}
+}
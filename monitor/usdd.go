@@ -0,0 +1,226 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"psm-monitor/abi"
+	"psm-monitor/config"
+	"psm-monitor/misc"
+	"psm-monitor/net"
+	"psm-monitor/slack"
+
+	"github.com/robfig/cron"
+)
+
+// zeroAddr is the tron address of 0x0, the sender of mints and the receiver of burns
+var zeroAddr = misc.ToTronAddr("0x" + strings.Repeat("0", 40))
+
+// supplyFlow is a mint, or a burn with a negative amount, at the time of its block
+type supplyFlow struct {
+	at     time.Time
+	amount *big.Int
+}
+
+// Supply monitors the total supply of USDD and its mints and burns.
+type Supply struct {
+	topic    string
+	chain    net.ChainProvider
+	token    string
+	decimals uint8
+
+	// psms maps the tracked PSM contracts to the symbol of their gem, to tell PSM-driven mints and burns apart
+	psms map[string]string
+
+	// flows within the net change window, oldest first
+	flows       []supplyFlow
+	isNetWarned bool
+
+	// flowLock guards the mint and burn totals, added up by the handler and reset by stats
+	flowLock sync.Mutex
+	// minted and burned since the last stats, psmMinted and psmBurned are the PSM-driven part of them
+	minted    *big.Int
+	burned    *big.Int
+	psmMinted *big.Int
+	psmBurned *big.Int
+
+	// check supply
+	cSupply *big.Int
+
+	// stats supply
+	sSupply *big.Int
+	sTime   time.Time
+}
+
+// StartUSDD starts the USDD supply monitor, a nil c starts it for replay with the event handlers only,
+// the supply is neither read nor reported
+func StartUSDD(ctx context.Context, c *cron.Cron, chain net.ChainProvider, concerned map[string]func(ctx context.Context, event *net.Event)) {
+	token := config.Get().USDD.Token
+	if len(token) == 0 {
+		return
+	}
+	supply := &Supply{
+		topic:     ":usdd: [USDD]",
+		chain:     chain,
+		token:     token,
+		decimals:  abi.Decimals(ctx, chain, token),
+		psms:      make(map[string]string),
+		minted:    big.NewInt(0),
+		burned:    big.NewInt(0),
+		psmMinted: big.NewInt(0),
+		psmBurned: big.NewInt(0),
+		sTime:     time.Now(),
+	}
+	for _, ilkConfig := range config.Get().PSM.Ilks {
+		gem := ilkConfig.Symbol
+		if len(gem) == 0 {
+			gem = abi.Name(ctx, chain, ilkConfig.Token)
+		}
+		supply.psms[ilkConfig.PSM] = gem
+	}
+	if c != nil {
+		supply.init(ctx)
+
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 0 */1 * * ?", misc.WrapLog(ctx, supply.report))
+		_ = c.AddFunc(strconv.Itoa(int(rand.Uint32()%60))+" 30 */6 * * ?", misc.WrapLog(ctx, supply.stats))
+	}
+
+	subscribe(concerned, token, supply.handleTransfer)
+}
+
+func (s *Supply) handleTransfer(ctx context.Context, event *net.Event) {
+	if event.EventName != "Transfer" {
+		return
+	}
+	amount := misc.ConvertDecN(event.BigInt("value"), s.decimals)
+	usddConfig := config.Get().USDD
+	var (
+		action    string
+		user      string
+		threshold int64
+	)
+	switch zeroAddr {
+	case event.Addr("from"):
+		action, user, threshold = "mint", event.Addr("to"), usddConfig.MintThreshold
+	case event.Addr("to"):
+		action, user, threshold = "burn", event.Addr("from"), usddConfig.BurnThreshold
+		amount.Neg(amount)
+	default:
+		return
+	}
+
+	// the PSM is the called contract of a PSM-driven mint or burn, routers calling it are counted as other sources
+	source, isPSM := "other", false
+	tx, err := s.chain.GetTransaction(ctx, event.TransactionHash)
+	if err != nil {
+		misc.Warn(s.topic+".handleTransfer", fmt.Sprintf("action=\"query tx %s\" reason=\"%s\"", event.TransactionHash, err.Error()))
+		source = "unknown"
+	} else if gem, ok := s.psms[tx.To]; ok {
+		source, isPSM = fmt.Sprintf("`%s` PSM", gem), true
+	} else if len(tx.To) != 0 {
+		source = fmt.Sprintf("contract `%s`", tx.To)
+	}
+
+	s.flowLock.Lock()
+	if action == "mint" {
+		s.minted.Add(s.minted, amount)
+		if isPSM {
+			s.psmMinted.Add(s.psmMinted, amount)
+		}
+	} else {
+		s.burned.Sub(s.burned, amount)
+		if isPSM {
+			s.psmBurned.Sub(s.psmBurned, amount)
+		}
+	}
+	s.flowLock.Unlock()
+
+	if amount.CmpAbs(big.NewInt(threshold)) >= 0 {
+		caller := ""
+		if tx != nil {
+			caller = misc.FormatUser(tx.From)
+		}
+		slack.SendMsg(ctx, s.topic, "Large %s, %s, via %s, receiver %s, caller %s, %s",
+			action,
+			misc.FormatTokenAmt(USDD, amount, true),
+			source,
+			misc.FormatUser(user),
+			caller,
+			misc.FormatTxUrl(event.TransactionHash))
+	}
+	s.handleNetChange(ctx, event, amount, usddConfig)
+}
+
+// handleNetChange alerts once the net supply change within the window reaches the threshold,
+// measured by block time so catch-up and replay count alike
+func (s *Supply) handleNetChange(ctx context.Context, event *net.Event, amount *big.Int, usddConfig config.USDDConfig) {
+	at := time.UnixMilli(event.BlockTimestamp)
+	window := time.Duration(usddConfig.NetChangeWindow) * time.Second
+	s.flows = append(s.flows, supplyFlow{at: at, amount: amount})
+	for len(s.flows) > 0 && at.Sub(s.flows[0].at) > window {
+		s.flows = s.flows[1:]
+	}
+	change := big.NewInt(0)
+	for _, flow := range s.flows {
+		change.Add(change, flow.amount)
+	}
+	threshold := big.NewInt(usddConfig.NetChangeThreshold)
+	if !s.isNetWarned && change.CmpAbs(threshold) >= 0 {
+		s.isNetWarned = true
+		slack.SendMsg(ctx, s.topic, ":warning: Net supply change in last `%s` reached %s, `%d` mints and burns, latest %s",
+			window, misc.FormatTokenAmt(USDD, change, true), len(s.flows), misc.FormatTxUrl(event.TransactionHash))
+	}
+	if change.CmpAbs(threshold) < 0 {
+		s.isNetWarned = false
+	}
+}
+
+func (s *Supply) init(ctx context.Context) {
+	supply := s.getSupply(ctx)
+	s.cSupply = supply
+	s.sSupply = supply
+	s.report(ctx)
+}
+
+func (s *Supply) report(ctx context.Context) {
+	supply := s.getSupply(ctx)
+	s.cSupply = supply
+	slack.SendMsg(ctx, s.topic, "State Report, total supply %s",
+		misc.FormatTokenAmt(USDD, supply, false))
+}
+
+func (s *Supply) stats(ctx context.Context) {
+	supply, now := s.getSupply(ctx), time.Now()
+	s.flowLock.Lock()
+	minted, burned, psmMinted, psmBurned := s.minted, s.burned, s.psmMinted, s.psmBurned
+	s.minted, s.burned, s.psmMinted, s.psmBurned = big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0)
+	s.flowLock.Unlock()
+	slack.SendMsg(ctx, s.topic, "Stats Report, from `%s` ~ `%s`, total supply %s, change %s, minted %s (PSM %s), burned %s (PSM %s)",
+		s.sTime.Format("15:04"), now.Format("15:04"),
+		misc.FormatTokenAmt(USDD, supply, false),
+		misc.FormatTokenAmt(USDD, new(big.Int).Sub(supply, s.sSupply), true),
+		misc.FormatTokenAmt(USDD, minted, false),
+		misc.FormatTokenAmt(USDD, psmMinted, false),
+		misc.FormatTokenAmt(USDD, burned, false),
+		misc.FormatTokenAmt(USDD, psmBurned, false))
+	s.sSupply, s.sTime = supply, now
+}
+
+// getSupply reads the total supply in whole tokens, it falls back to the c-value when it cannot be read
+func (s *Supply) getSupply(ctx context.Context) *big.Int {
+	supply, err := abi.NewERC20(s.chain, s.token).TotalSupply(ctx)
+	if err != nil {
+		misc.Warn(s.topic+".getSupply", fmt.Sprintf("action=\"query USDD total supply\" reason=\"%s\"", err.Error()))
+		if s.cSupply == nil {
+			return big.NewInt(0)
+		}
+		return s.cSupply
+	}
+	return misc.ConvertDecN(supply, s.decimals)
+}
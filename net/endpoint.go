@@ -0,0 +1,203 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"psm-monitor/misc"
+)
+
+const (
+	// healthAlpha is the weight of the newest sample in the moving averages
+	healthAlpha = 0.2
+	// unhealthyErrorRate is the error rate above which an endpoint is marked down
+	unhealthyErrorRate = 0.5
+
+	defaultMaxBlockLag = 20
+)
+
+// pendingNotifications counts the state change notifications in flight, so shutdown can wait for them
+var pendingNotifications sync.WaitGroup
+
+// WaitNotifications blocks until all endpoint state change notifications in flight returned
+func WaitNotifications() {
+	pendingNotifications.Wait()
+}
+
+// Endpoint is one url serving a role, e.g. a full node or an event server.
+type Endpoint struct {
+	URL string
+
+	// latency is the moving average of successful request cost in milliseconds
+	latency float64
+	// errorRate is the moving average of failed requests, between 0 and 1
+	errorRate float64
+	// blockLag is how many blocks this endpoint is behind the highest one in the pool
+	blockLag uint64
+	healthy  bool
+}
+
+// EndpointPool routes requests to the healthiest endpoint of a role and fails over to the others.
+type EndpointPool struct {
+	role        string
+	maxBlockLag uint64
+	notify      func(content string)
+
+	lock      sync.Mutex
+	endpoints []*Endpoint
+}
+
+// NewEndpointPool creates a pool for the given role, notify is called on endpoint state changes and may be nil.
+func NewEndpointPool(role string, urls []string, maxBlockLag uint64, notify func(content string)) *EndpointPool {
+	if maxBlockLag == 0 {
+		maxBlockLag = defaultMaxBlockLag
+	}
+	pool := &EndpointPool{role: role, maxBlockLag: maxBlockLag, notify: notify}
+	for _, url := range urls {
+		pool.endpoints = append(pool.endpoints, &Endpoint{URL: url, healthy: true})
+	}
+	return pool
+}
+
+// Do calls fn with the endpoint urls from the healthiest to the least healthy one,
+// until fn succeeds or fails with an error that is not caused by the endpoint.
+func (p *EndpointPool) Do(ctx context.Context, fn func(url string) error) error {
+	ranked := p.ranked()
+	if len(ranked) == 0 {
+		return fmt.Errorf("net: no %s endpoint configured", p.role)
+	}
+	// a single endpoint is still tried as many times as a plain request
+	attempts := len(ranked)
+	if attempts < defaultAttempts {
+		attempts = defaultAttempts
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		endpoint := ranked[i%len(ranked)]
+		startAt := time.Now()
+		err = fn(endpoint.URL)
+		failed := errors.Is(err, ErrHttpFailed)
+		p.record(endpoint, time.Now().Sub(startAt), failed)
+		if !failed || ctx.Err() != nil {
+			return err
+		}
+		misc.Warn("Endpoint failover", fmt.Sprintf("role=%s url=%s reason=\"%s\"", p.role, endpoint.URL, err.Error()))
+	}
+	return err
+}
+
+// Get sends a GET request for path to the healthiest endpoint
+func (p *EndpointPool) Get(ctx context.Context, path string, chkFn func([]byte) error) ([]byte, error) {
+	var resData []byte
+	err := p.Do(ctx, func(url string) (err error) {
+		resData, err = get(ctx, url+path, chkFn, 1)
+		return err
+	})
+	return resData, err
+}
+
+// Post sends a POST request for path to the healthiest endpoint
+func (p *EndpointPool) Post(ctx context.Context, path string, d interface{}, chkFn func([]byte) error) ([]byte, error) {
+	var resData []byte
+	err := p.Do(ctx, func(url string) (err error) {
+		resData, err = post(ctx, url+path, d, chkFn, 1)
+		return err
+	})
+	return resData, err
+}
+
+// CheckHealth probes the block height of every endpoint and updates their block lag.
+func (p *EndpointPool) CheckHealth(ctx context.Context, probe func(ctx context.Context, url string) (uint64, error)) {
+	heights := make(map[*Endpoint]uint64)
+	var highest uint64
+	for _, endpoint := range p.ranked() {
+		startAt := time.Now()
+		height, err := probe(ctx, endpoint.URL)
+		if ctx.Err() != nil {
+			return
+		}
+		p.record(endpoint, time.Now().Sub(startAt), err != nil)
+		if err == nil {
+			heights[endpoint] = height
+			if height > highest {
+				highest = height
+			}
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for endpoint, height := range heights {
+		endpoint.blockLag = highest - height
+		p.updateState(endpoint)
+	}
+}
+
+// ranked returns the endpoints sorted by their health score, the healthiest first
+func (p *EndpointPool) ranked() []*Endpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ranked := make([]*Endpoint, len(p.endpoints))
+	copy(ranked, p.endpoints)
+	scores := make(map[*Endpoint]float64)
+	for _, endpoint := range ranked {
+		scores[endpoint] = p.score(endpoint)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i]] > scores[ranked[j]]
+	})
+	return ranked
+}
+
+// score rates an endpoint between 0 and 1 by its error rate, latency and block lag
+func (p *EndpointPool) score(endpoint *Endpoint) float64 {
+	lagFactor := 1 - float64(endpoint.blockLag)/float64(2*(p.maxBlockLag+1))
+	if endpoint.blockLag > p.maxBlockLag {
+		lagFactor = 0.01
+	}
+	return (1 - endpoint.errorRate) / (1 + endpoint.latency/1000) * lagFactor
+}
+
+func (p *EndpointPool) record(endpoint *Endpoint, cost time.Duration, failed bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if failed {
+		endpoint.errorRate = endpoint.errorRate*(1-healthAlpha) + healthAlpha
+	} else {
+		endpoint.errorRate = endpoint.errorRate * (1 - healthAlpha)
+		if endpoint.latency == 0 {
+			endpoint.latency = float64(cost.Milliseconds())
+		} else {
+			endpoint.latency = endpoint.latency*(1-healthAlpha) + float64(cost.Milliseconds())*healthAlpha
+		}
+	}
+	p.updateState(endpoint)
+}
+
+// updateState marks the endpoint up or down, the caller must hold the lock
+func (p *EndpointPool) updateState(endpoint *Endpoint) {
+	healthy := endpoint.errorRate < unhealthyErrorRate && endpoint.blockLag <= p.maxBlockLag
+	if healthy == endpoint.healthy {
+		return
+	}
+	endpoint.healthy = healthy
+	state := "down"
+	if healthy {
+		state = "up"
+	}
+	content := fmt.Sprintf("%s endpoint `%s` is %s, error rate - `%.2f`, latency - `%.0fms`, block lag - `%d`",
+		p.role, endpoint.URL, state, endpoint.errorRate, endpoint.latency, endpoint.blockLag)
+	misc.Warn("Endpoint state change", content)
+	if p.notify != nil {
+		// notify outside the lock, the pool keeps serving requests while the message is sent
+		pendingNotifications.Add(1)
+		go func() {
+			defer pendingNotifications.Done()
+			p.notify(content)
+		}()
+	}
+}
@@ -0,0 +1,85 @@
+package net
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+
+	"psm-monitor/misc"
+)
+
+// Log is a raw event log of a transaction, as returned by the full node.
+type Log struct {
+	// Address is the hex address of the emitting contract, without the 41 prefix
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+	Data    string   `json:"data"`
+}
+
+// LogDecoder decodes a raw log into its event name, signature and arguments, ok is false for unknown events.
+type LogDecoder func(log *Log) (name, signature string, result map[string]interface{}, ok bool)
+
+var logDecoder LogDecoder
+
+// SetLogDecoder sets the decoder used for events read from full node transaction infos
+func SetLogDecoder(decoder LogDecoder) {
+	logDecoder = decoder
+}
+
+// BigInt returns a copy of the integer argument, 0 if it is missing.
+// Decoded logs carry big ints, the event server carries decimal strings.
+func (e *Event) BigInt(name string) *big.Int {
+	switch v := e.Result[name].(type) {
+	case *big.Int:
+		return new(big.Int).Set(v)
+	case uint8:
+		return big.NewInt(int64(v))
+	case string:
+		if n, ok := new(big.Int).SetString(v, 10); ok {
+			return n
+		}
+	}
+	return big.NewInt(0)
+}
+
+// BigInts returns a copy of the integer array argument,
+// the event server joins array items with newlines or commas.
+func (e *Event) BigInts(name string) []*big.Int {
+	switch v := e.Result[name].(type) {
+	case []*big.Int:
+		nums := make([]*big.Int, len(v))
+		for i, n := range v {
+			nums[i] = new(big.Int).Set(n)
+		}
+		return nums
+	case string:
+		var nums []*big.Int
+		for _, field := range strings.FieldsFunc(v, func(r rune) bool { return !unicode.IsDigit(r) && r != '-' }) {
+			n, _ := new(big.Int).SetString(field, 10)
+			if n == nil {
+				n = big.NewInt(0)
+			}
+			nums = append(nums, n)
+		}
+		return nums
+	}
+	return nil
+}
+
+// Addr returns the address argument in base58, the event server gives hex addresses
+func (e *Event) Addr(name string) string {
+	addr, _ := e.Result[name].(string)
+	if strings.HasPrefix(addr, "0x") || len(addr) == 42 && strings.HasPrefix(addr, "41") {
+		return misc.ToTronAddr(addr)
+	}
+	return addr
+}
+
+// String returns the argument formatted with its default format
+func (e *Event) String(name string) string {
+	if v, ok := e.Result[name]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
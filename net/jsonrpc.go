@@ -0,0 +1,179 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"psm-monitor/misc"
+)
+
+// JsonRpcProvider reads the chain through the Ethereum compatible JSON-RPC of TRON full nodes.
+type JsonRpcProvider struct {
+	nodes *EndpointPool
+}
+
+func NewJsonRpcProvider(nodes *EndpointPool) *JsonRpcProvider {
+	return &JsonRpcProvider{nodes: nodes}
+}
+
+func (j *JsonRpcProvider) BlockNumber(ctx context.Context) (uint64, error) {
+	var result string
+	if err := callJsonRpc(ctx, j.nodes, "eth_blockNumber", &result); err != nil {
+		return 0, err
+	}
+	return hexutil.DecodeUint64(result)
+}
+
+func (j *JsonRpcProvider) GetBlock(ctx context.Context, blockNumber uint64) (*Block, error) {
+	var result *JsonRpcBlock
+	if err := callJsonRpc(ctx, j.nodes, "eth_getBlockByNumber", &result, hexutil.EncodeUint64(blockNumber), false); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrNoReturn
+	}
+	number, err := hexutil.DecodeUint64(result.Number)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, _ := hexutil.DecodeUint64(result.Timestamp)
+	// keep hashes in the same form as the full node HTTP API
+	return &Block{
+		Number:     number,
+		Hash:       strings.TrimPrefix(result.Hash, "0x"),
+		ParentHash: strings.TrimPrefix(result.ParentHash, "0x"),
+		Timestamp:  int64(timestamp) * 1000,
+	}, nil
+}
+
+// GetBlockEvents decodes the raw logs of the block returned by eth_getLogs with the log decoder,
+// logs the decoder does not know are skipped. Events are ordered by their log index in the block.
+func (j *JsonRpcProvider) GetBlockEvents(ctx context.Context, blockNumber uint64) ([]*Event, error) {
+	if logDecoder == nil {
+		return nil, fmt.Errorf("net: no log decoder set: %w", ErrUnsupported)
+	}
+	block, err := j.GetBlock(ctx, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	// the block hash filter pins the logs to the block read above, even if the chain reorganizes in between
+	var logs []*JsonRpcLog
+	if err := callJsonRpc(ctx, j.nodes, "eth_getLogs", &logs, map[string]string{"blockHash": "0x" + block.Hash}); err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0, len(logs))
+	for _, log := range logs {
+		if log.Removed {
+			continue
+		}
+		name, signature, result, ok := logDecoder(&log.Log)
+		if !ok {
+			continue
+		}
+		txIndex, err := hexutil.DecodeUint64(log.TransactionIndex)
+		if err != nil {
+			return nil, fmt.Errorf("net: transaction index %q: %w", log.TransactionIndex, err)
+		}
+		logIndex, err := hexutil.DecodeUint64(log.LogIndex)
+		if err != nil {
+			return nil, fmt.Errorf("net: log index %q: %w", log.LogIndex, err)
+		}
+		events = append(events, &Event{
+			BlockNumber:      block.Number,
+			BlockTimestamp:   block.Timestamp,
+			Address:          misc.ToTronAddr(log.Address),
+			TransactionIndex: uint(txIndex),
+			LogIndex:         uint(logIndex),
+			EventName:        name,
+			Event:            signature,
+			TransactionHash:  strings.TrimPrefix(log.TransactionHash, "0x"),
+			Result:           result,
+		})
+	}
+	sort.SliceStable(events, func(a, b int) bool { return events[a].LogIndex < events[b].LogIndex })
+	return events, nil
+}
+
+func (j *JsonRpcProvider) Trigger(ctx context.Context, addr, selector, param string) (string, error) {
+	data := append(crypto.Keccak256([]byte(selector))[:4], common.FromHex(param)...)
+	call := map[string]string{
+		"to":   misc.ToHexAddr(addr),
+		"data": hexutil.Encode(data),
+	}
+	var result string
+	if err := callJsonRpc(ctx, j.nodes, "eth_call", &result, call, "latest"); err != nil {
+		if _, ok := err.(*JsonRpcError); ok {
+			return "", ErrQueryFailed
+		}
+		return "", err
+	}
+	if len(result) <= 2 {
+		return "", ErrNoReturn
+	}
+	return strings.TrimPrefix(result, "0x"), nil
+}
+
+func (j *JsonRpcProvider) GetTransaction(ctx context.Context, id string) (*Transaction, error) {
+	var result *JsonRpcTransaction
+	if err := callJsonRpc(ctx, j.nodes, "eth_getTransactionByHash", &result, "0x"+id); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrNoReturn
+	}
+	tx := &Transaction{Hash: strings.TrimPrefix(result.Hash, "0x"), From: misc.ToTronAddr(result.From)}
+	if len(result.To) != 0 {
+		tx.To = misc.ToTronAddr(result.To)
+	}
+	return tx, nil
+}
+
+// CheckHealth probes the block height of every full node
+func (j *JsonRpcProvider) CheckHealth(ctx context.Context) {
+	j.nodes.CheckHealth(ctx, probeJsonRpcBlockNumber)
+}
+
+func probeJsonRpcBlockNumber(ctx context.Context, url string) (uint64, error) {
+	data, err := post(ctx, url+JsonRpcPath, newJsonRpcRequest("eth_blockNumber", nil), nil, 1)
+	if err != nil {
+		return 0, err
+	}
+	var result string
+	if err := decodeJsonRpcResponse(data, &result); err != nil {
+		return 0, err
+	}
+	return hexutil.DecodeUint64(result)
+}
+
+func callJsonRpc(ctx context.Context, nodes *EndpointPool, method string, result interface{}, params ...interface{}) error {
+	data, err := nodes.Post(ctx, JsonRpcPath, newJsonRpcRequest(method, params), nil)
+	if err != nil {
+		return err
+	}
+	return decodeJsonRpcResponse(data, result)
+}
+
+func newJsonRpcRequest(method string, params []interface{}) *JsonRpcRequest {
+	if params == nil {
+		params = make([]interface{}, 0)
+	}
+	return &JsonRpcRequest{Version: "2.0", ID: 233, Method: method, Params: params}
+}
+
+func decodeJsonRpcResponse(data []byte, result interface{}) error {
+	var rspMsg JsonRpcResponse
+	if err := json.Unmarshal(data, &rspMsg); err != nil {
+		return err
+	}
+	if rspMsg.Error != nil {
+		return rspMsg.Error
+	}
+	return json.Unmarshal(rspMsg.Result, result)
+}
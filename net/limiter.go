@@ -0,0 +1,211 @@
+package net
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"psm-monitor/config"
+)
+
+const (
+	// APIKeyHeader carries the TronGrid API key
+	APIKeyHeader = "TRON-PRO-API-KEY"
+
+	throttleBaseBackoff = 500 * time.Millisecond
+	throttleMaxBackoff  = 30 * time.Second
+)
+
+// tokenBucket allows rate requests per second on average, with bursts up to burst requests.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes one token and returns how long the caller must wait before using it
+func (b *tokenBucket) reserve() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// hostPolicy holds the API keys, rate limit and throttle state of one host.
+type hostPolicy struct {
+	keys   []string
+	bucket *tokenBucket
+
+	lock         sync.Mutex
+	nextKey      int
+	strikes      int
+	blockedUntil time.Time
+}
+
+var (
+	hostPolicies     = make(map[string]*hostPolicy)
+	hostPoliciesLock sync.Mutex
+)
+
+// SetEndpointPolicies sets the API keys rotated across requests to the host of every endpoint,
+// and limits them to the rate requests per second of the endpoint when it is positive.
+// Endpoints on the same host, e.g. a full node and an event server both at api.trongrid.io, share one policy,
+// as the host throttles them together: their keys are merged, and their rates and bursts add up,
+// unless one of them is unlimited, which leaves the host unlimited.
+func SetEndpointPolicies(endpoints []config.EndpointConfig) {
+	type hostLimit struct {
+		rate  float64
+		burst int
+	}
+	policies := make(map[string]*hostPolicy)
+	limits := make(map[string]*hostLimit)
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil {
+			continue
+		}
+		policy, ok := policies[u.Host]
+		if !ok {
+			policy = &hostPolicy{}
+			policies[u.Host] = policy
+			limits[u.Host] = &hostLimit{rate: endpoint.RateLimit, burst: endpoint.Burst}
+		} else if limit := limits[u.Host]; limit.rate > 0 && endpoint.RateLimit > 0 {
+			limit.rate += endpoint.RateLimit
+			limit.burst += endpoint.Burst
+		} else {
+			limit.rate = 0
+		}
+		for _, key := range endpoint.APIKeys {
+			if !containsString(policy.keys, key) {
+				policy.keys = append(policy.keys, key)
+			}
+		}
+	}
+	for host, limit := range limits {
+		if limit.rate > 0 {
+			policies[host].bucket = newTokenBucket(limit.rate, limit.burst)
+		}
+	}
+
+	hostPoliciesLock.Lock()
+	defer hostPoliciesLock.Unlock()
+	for host, policy := range policies {
+		hostPolicies[host] = policy
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getHostPolicy returns the policy for the host, hosts never configured get a policy without keys and limits
+func getHostPolicy(host string) *hostPolicy {
+	hostPoliciesLock.Lock()
+	defer hostPoliciesLock.Unlock()
+	policy, ok := hostPolicies[host]
+	if !ok {
+		policy = &hostPolicy{}
+		hostPolicies[host] = policy
+	}
+	return policy
+}
+
+// wait blocks until the host is no longer throttled and a token is available, or ctx is done
+func (p *hostPolicy) wait(ctx context.Context) error {
+	p.lock.Lock()
+	delay := time.Until(p.blockedUntil)
+	p.lock.Unlock()
+	if delay < 0 {
+		delay = 0
+	}
+	if p.bucket != nil {
+		delay += p.bucket.reserve()
+	}
+	if delay == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// apply sets the next API key on the request
+func (p *hostPolicy) apply(req *http.Request) {
+	if len(p.keys) == 0 {
+		return
+	}
+	p.lock.Lock()
+	key := p.keys[p.nextKey%len(p.keys)]
+	p.nextKey++
+	p.lock.Unlock()
+	req.Header.Set(APIKeyHeader, key)
+}
+
+// throttled backs the host off for the Retry-After of res, or exponentially when it is absent,
+// and returns the backoff.
+func (p *hostPolicy) throttled(res *http.Response) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	backoff := throttleBaseBackoff << p.strikes
+	if backoff > throttleMaxBackoff || backoff <= 0 {
+		backoff = throttleMaxBackoff
+	}
+	if retryAfter := parseRetryAfter(res.Header.Get("Retry-After")); retryAfter > backoff {
+		backoff = retryAfter
+	}
+	p.strikes++
+	p.blockedUntil = time.Now().Add(backoff)
+	return backoff
+}
+
+// succeeded resets the exponential backoff of the host
+func (p *hostPolicy) succeeded() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.strikes = 0
+}
+
+// parseRetryAfter accepts both delay seconds and http date forms
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package net
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"psm-monitor/config"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := newTokenBucket(10, 2)
+	if bucket.reserve() != 0 || bucket.reserve() != 0 {
+		t.Fatal("burst tokens should be available immediately")
+	}
+	if delay := bucket.reserve(); delay <= 0 || delay > 100*time.Millisecond {
+		t.Fatalf("third token should wait about 100ms, got %s", delay)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if parseRetryAfter("3") != 3*time.Second {
+		t.Fail()
+	}
+	if parseRetryAfter("") != 0 || parseRetryAfter("soon") != 0 {
+		t.Fail()
+	}
+	date := time.Now().Add(time.Minute).UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	if delay := parseRetryAfter(date); delay <= 50*time.Second || delay > time.Minute {
+		t.Fatalf("http date should be about one minute ahead, got %s", delay)
+	}
+}
+
+func TestSetEndpointPolicies(t *testing.T) {
+	SetEndpointPolicies([]config.EndpointConfig{
+		{URL: "https://policy.trongrid.io/", APIKeys: []string{"a", "b"}, RateLimit: 10, Burst: 20},
+		{URL: "https://policy.trongrid.io/", APIKeys: []string{"b", "c"}, RateLimit: 5, Burst: 10},
+		{URL: "https://unlimited.trongrid.io/", RateLimit: 5, Burst: 10},
+		{URL: "https://unlimited.trongrid.io/"},
+	})
+	// endpoints on the same host share the keys and the summed limits of both
+	policy := getHostPolicy("policy.trongrid.io")
+	if strings.Join(policy.keys, ",") != "a,b,c" || policy.bucket == nil || policy.bucket.rate != 15 || policy.bucket.burst != 30 {
+		t.Errorf("policy keys = %v, bucket = %+v", policy.keys, policy.bucket)
+	}
+	if policy := getHostPolicy("unlimited.trongrid.io"); policy.bucket != nil {
+		t.Errorf("unlimited endpoint is limited by %+v", policy.bucket)
+	}
+}
@@ -2,37 +2,41 @@ package net
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/thedevsaddam/gojsonq/v2"
 	"psm-monitor/config"
 	"psm-monitor/misc"
-
-	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/status-im/keycard-go/hexutils"
 )
 
 const (
 	TriggerPath      = "wallet/triggerconstantcontract"
 	ParametersPath   = "wallet/getchainparameters"
+	BlockPath        = "wallet/getblock"
+	TransactionPath  = "wallet/gettransactionbyid"
+	TxInfoPath       = "wallet/gettransactioninfobyblocknum"
+	JsonRpcPath      = "jsonrpc"
 	BlockEventsPath  = "v1/blocks/%d/events?limit=200"
 	LatestEventsPath = "v1/blocks/latest/events?limit=200"
 )
 
+// defaultAttempts is how many times a request to a single url is tried
+const defaultAttempts = 3
+
 var ErrHttpFailed = errors.New("net: http request failed")
 var ErrNoReturn = errors.New("net: no return data")
 var ErrQueryFailed = errors.New("net: query failed")
+var ErrUnsupported = errors.New("net: not supported by the chain provider")
 
 var dialer = net.Dialer{
 	Timeout:   30 * time.Second,
@@ -57,41 +61,8 @@ var defaultHTTPClient = &http.Client{
 	Timeout:   3 * time.Second,
 }
 
-func newJsonRpcMessage(method string, params []byte) *JsonRpcMessage {
-	return &JsonRpcMessage{
-		Version: "2.0",
-		ID:      233,
-		Method:  method,
-		Params:  hexutils.BytesToHex(params),
-	}
-}
-
-func CallJsonRpc(method string, params []byte) ([]byte, error) {
-	data, err := Post(config.Get().EventServer+"jsonrpc", newJsonRpcMessage(method, params), nil)
-	if err != nil {
-		return nil, err
-	}
-	var rspMsg JsonRpcMessage
-	if err := json.Unmarshal(data, &rspMsg); err == nil {
-		if len(rspMsg.Result)%2 == 1 {
-			return hexutil.MustDecode(strings.ReplaceAll(rspMsg.Result, "0x", "0x0")), nil
-		}
-		return hexutil.MustDecode(rspMsg.Result), nil
-	} else {
-		return nil, err
-	}
-}
-
-func BlockNumber() uint64 {
-	if resData, resErr := CallJsonRpc("eth_blockNumber", nil); resErr == nil {
-		return new(big.Int).SetBytes(resData).Uint64()
-	} else {
-		return 0
-	}
-}
-
-func GetPrice(token string) float64 {
-	result, err := Get("https://c.tronlink.org/v1/cryptocurrency/getprice?convert=USD&symbol="+token, nil)
+func GetPrice(ctx context.Context, token string) float64 {
+	result, err := Get(ctx, "https://c.tronlink.org/v1/cryptocurrency/getprice?convert=USD&symbol="+token, nil)
 	if err != nil {
 		return 0
 	}
@@ -105,8 +76,8 @@ func GetPrice(token string) float64 {
 	return price
 }
 
-func GetSolPrice() float64 {
-	result, err := Get("https://api.coingecko.com/api/v3/simple/price?ids=solana&vs_currencies=usd", nil)
+func GetSolPrice(ctx context.Context) float64 {
+	result, err := Get(ctx, "https://api.coingecko.com/api/v3/simple/price?ids=solana&vs_currencies=usd", nil)
 	if err != nil {
 		return 0
 	}
@@ -116,19 +87,20 @@ func GetSolPrice() float64 {
 	return price
 }
 
-func GetGasPrice(chain string) float64 {
+func GetGasPrice(ctx context.Context, chain string) float64 {
+	keys := config.Get().APIKeys
 	endpoint := ""
 	switch chain {
 	case "Ethereum":
-		endpoint = "https://api.etherscan.io/api?module=gastracker&action=gasoracle&apikey=82SMH9HIUESXN4IPSFA237VHIMHQB1AQSI"
+		endpoint = "https://api.etherscan.io/api?module=gastracker&action=gasoracle&apikey=" + keys.Etherscan
 	case "BSC":
-		endpoint = "https://api.bscscan.com/api?module=gastracker&action=gasoracle&apikey=2KQEVAIUCKJ6E5GZAQN8HUDPM7FSSSRS54"
+		endpoint = "https://api.bscscan.com/api?module=gastracker&action=gasoracle&apikey=" + keys.BscScan
 	case "Polygon":
-		endpoint = "https://api.polygonscan.com/api?module=gastracker&action=gasoracle&apikey=QV6MEUX33CS6J8M478MIISG8UW257NKMZS"
+		endpoint = "https://api.polygonscan.com/api?module=gastracker&action=gasoracle&apikey=" + keys.PolygonScan
 	default:
 		return 0.0
 	}
-	result, err := Get(endpoint, nil)
+	result, err := Get(ctx, endpoint, nil)
 	if err != nil {
 		return 0
 	}
@@ -142,8 +114,8 @@ func GetGasPrice(chain string) float64 {
 	return gasPrice
 }
 
-func GetAvalanchePrice() float64 {
-	response, err := Get("https://api.owlracle.info/v4/avax/gas?apikey=19bb332f8f5746f69c96fd2925b46f56", nil)
+func GetAvalanchePrice(ctx context.Context) float64 {
+	response, err := Get(ctx, "https://api.owlracle.info/v4/avax/gas?apikey="+config.Get().APIKeys.Owlracle, nil)
 	if err != nil {
 		return 0
 	}
@@ -177,8 +149,8 @@ func GetAvalanchePrice() float64 {
 	return 0.0
 }
 
-func GetEnergyPriceAndFactor() (float64, float64) {
-	result, err := Get(config.Get().FullNode+ParametersPath, nil)
+func GetEnergyPriceAndFactor(ctx context.Context) (float64, float64) {
+	result, err := Get(ctx, config.Get().FullNodeEndpoints()[0].URL+ParametersPath, nil)
 	if err != nil {
 		return 0, 0
 	}
@@ -187,83 +159,44 @@ func GetEnergyPriceAndFactor() (float64, float64) {
 	return parameters[11].(map[string]interface{})["value"].(float64), parameters[62].(map[string]interface{})["value"].(float64)
 }
 
-func GetBlockEvents(blockNumber uint64) []*Event {
-	return getEvents(config.Get().EventServer + fmt.Sprintf(BlockEventsPath, blockNumber))
-}
-
-func GetLatestBlockEvents() []*Event {
-	return getEvents(config.Get().EventServer + LatestEventsPath)
-}
-
-func getEvents(url string) []*Event {
-	allEvents := make([]*Event, 0)
-	events := Events{}
-	events.Meta.Links.Next = url
-	for len(events.Meta.Links.Next) != 0 {
-		rspData, err := Get(events.Meta.Links.Next, nil)
-		if err != nil {
-			break
-		}
-		events = Events{}
-		if err := json.Unmarshal(rspData, &events); err == nil {
-			allEvents = append(allEvents, events.Data...)
-		}
-	}
-	return allEvents
-}
-
-func GetTxFrom(id string) string {
-	if resData, netErr := Get("https://apilist.tronscanapi.com/api/transaction-info?hash="+id, nil); netErr == nil {
-		result := make(map[string]interface{})
-		if jsonErr := json.Unmarshal(resData, &result); jsonErr == nil {
-			return result["ownerAddress"].(string)
-		}
-	}
-	return ""
+func Get(ctx context.Context, url string, chkFn func([]byte) error) ([]byte, error) {
+	return get(ctx, url, chkFn, defaultAttempts)
 }
 
-func Trigger(addr, selector, param string) (string, error) {
-	resData, err := Post(config.Get().FullNode+TriggerPath, TriggerRequest{
-		OwnerAddress:     "T9yD14Nj9j7xAB4dbGeiX9h8unkKHxuWwb",
-		ContractAddress:  addr,
-		FunctionSelector: selector,
-		Parameter:        param,
-		Visible:          true,
-	}, nil)
-	if err != nil {
-		return "", err
-	}
-	var queryRes TriggerResponse
-	_ = json.Unmarshal(resData, &queryRes)
-	if !queryRes.RpcResult.TriggerResult {
-		return "", ErrQueryFailed
-	}
-	if len(queryRes.Result) > 0 {
-		return queryRes.Result[0], nil
-	}
-	return "", ErrNoReturn
+func Post(ctx context.Context, url string, d interface{}, chkFn func([]byte) error) ([]byte, error) {
+	return post(ctx, url, d, chkFn, defaultAttempts)
 }
 
-func Get(url string, chkFn func([]byte) error) ([]byte, error) {
-	req, _ := http.NewRequest("GET", url, nil)
-	return doRequestWithRetry(req, []byte("nil"), chkFn)
+func get(ctx context.Context, url string, chkFn func([]byte) error, attempts int) ([]byte, error) {
+	return doRequestWithRetry(ctx, http.MethodGet, url, nil, chkFn, attempts)
 }
 
-func Post(url string, d interface{}, chkFn func([]byte) error) ([]byte, error) {
+func post(ctx context.Context, url string, d interface{}, chkFn func([]byte) error, attempts int) ([]byte, error) {
 	reqData, jsonErr := json.Marshal(d)
 	if jsonErr != nil {
 		return nil, jsonErr
 	}
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(reqData))
-	req.Header.Set("Content-Type", "application/json")
-	return doRequestWithRetry(req, reqData, chkFn)
+	return doRequestWithRetry(ctx, http.MethodPost, url, reqData, chkFn, attempts)
 }
 
-func doRequestWithRetry(req *http.Request, body []byte, chkFn func([]byte) error) ([]byte, error) {
+// doRequestWithRetry builds a fresh request for every attempt, so the body is never reused after being read
+func doRequestWithRetry(ctx context.Context, method, url string, body []byte, chkFn func([]byte) error, attempts int) ([]byte, error) {
 	reqId := rand.Uint32()
 	title := "Http request report"
-	misc.Info(title, fmt.Sprintf("url=%s method=%s data=%s reqid=%d", req.URL, req.Method, string(body), reqId))
-	for i := 1; i <= 3; i++ {
+	misc.Info(title, fmt.Sprintf("url=%s method=%s data=%s reqid=%d", url, method, string(body), reqId))
+	for i := 1; i <= attempts; i++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		policy := getHostPolicy(req.URL.Host)
+		if err := policy.wait(ctx); err != nil {
+			return nil, err
+		}
+		policy.apply(req)
 		startAt := time.Now()
 		retRes, retErr := defaultHTTPClient.Do(req)
 		cost := time.Now().Sub(startAt).Milliseconds()
@@ -275,12 +208,23 @@ func doRequestWithRetry(req *http.Request, body []byte, chkFn func([]byte) error
 					chkErr = chkFn(body)
 				}
 				if chkErr == nil {
+					policy.succeeded()
 					misc.Debug(title, fmt.Sprintf("status=success reqid=%d cost=%dms", reqId, cost))
 					return body, nil
 				}
 			}
 			_ = retRes.Body.Close()
 		}
+		if retErr == nil && retRes.StatusCode == http.StatusTooManyRequests {
+			_ = retRes.Body.Close()
+			backoff := policy.throttled(retRes)
+			misc.Warn(title, fmt.Sprintf("status=throttled reqid=%d cost=%dms times=%dth backoff=%s", reqId, cost, i, backoff))
+			continue
+		}
+		if ctx.Err() != nil {
+			misc.Warn(title, fmt.Sprintf("status=canceled reqid=%d cost=%dms reason=\"%s\"", reqId, cost, ctx.Err().Error()))
+			return nil, ctx.Err()
+		}
 		if retErr != nil {
 			misc.Debug(title, fmt.Sprintf("status=retry reqid=%d cost=%dms times=%dth reason=\"%s\"", reqId, cost, i, retErr.Error()))
 		} else if chkErr != nil {
@@ -289,6 +233,6 @@ func doRequestWithRetry(req *http.Request, body []byte, chkFn func([]byte) error
 			misc.Debug(title, fmt.Sprintf("status=retry reqid=%d cost=%dms times=%dth reason=\"invalid status code %d\"", reqId, cost, i, retRes.StatusCode))
 		}
 	}
-	misc.Error(title, fmt.Sprintf("status=failed reqid=%d reason=\"retry exceed three times\"", reqId))
+	misc.Error(title, fmt.Sprintf("status=failed reqid=%d reason=\"retry exceed %d times\"", reqId, attempts))
 	return nil, ErrHttpFailed
 }
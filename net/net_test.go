@@ -1,12 +1,45 @@
 package net
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 )
 
-func TestGetTxFrom(t *testing.T) {
-	if !reflect.DeepEqual(GetTxFrom("743a90e62590728a56c6078af55a38e74d1533f2430ca59c27d50f57fc34b8f1"), "TNYmZq4oppcQrAA55xydbD7GPtrR49ULL6") {
+func TestGetTransaction(t *testing.T) {
+	endpoints := []string{"https://api.trongrid.io/"}
+	chain := NewTronGridProvider(NewEndpointPool("full node", endpoints, 0, nil), NewEndpointPool("event server", endpoints, 0, nil))
+	tx, err := chain.GetTransaction(context.Background(), "743a90e62590728a56c6078af55a38e74d1533f2430ca59c27d50f57fc34b8f1")
+	if err != nil || !reflect.DeepEqual(tx.From, "TNYmZq4oppcQrAA55xydbD7GPtrR49ULL6") {
 		t.Fail()
 	}
 }
+
+func TestWaitNotifications(t *testing.T) {
+	release, sent := make(chan struct{}), make(chan string, 1)
+	pool := NewEndpointPool("full node", []string{"https://a/"}, 0, func(content string) {
+		<-release
+		sent <- content
+	})
+	pool.lock.Lock()
+	pool.endpoints[0].errorRate = 1
+	pool.updateState(pool.endpoints[0])
+	pool.lock.Unlock()
+
+	waited := make(chan struct{})
+	go func() {
+		WaitNotifications()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("WaitNotifications() returns before the notification is sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-waited
+	if len(sent) != 1 {
+		t.Error("notification is not sent")
+	}
+}
@@ -0,0 +1,55 @@
+package net
+
+import (
+	"context"
+
+	"psm-monitor/config"
+)
+
+// ChainProvider is the source of all chain data the monitors need.
+type ChainProvider interface {
+	// BlockNumber returns the number of the latest block
+	BlockNumber(ctx context.Context) (uint64, error)
+	// GetBlock returns the header of the block with the given number
+	GetBlock(ctx context.Context, blockNumber uint64) (*Block, error)
+	// GetBlockEvents returns all decoded events emitted in the block with the given number
+	GetBlockEvents(ctx context.Context, blockNumber uint64) ([]*Event, error)
+	// Trigger calls a constant contract method and returns the hex encoded result
+	Trigger(ctx context.Context, addr, selector, param string) (string, error)
+	// GetTransaction looks up the transaction with the given id
+	GetTransaction(ctx context.Context, id string) (*Transaction, error)
+}
+
+// HealthChecker is implemented by chain providers that can probe their endpoints.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context)
+}
+
+// NewChainProvider builds the chain provider selected by the `provider` config item,
+// notify is called when an endpoint goes down or comes back and may be nil.
+func NewChainProvider(notify func(content string)) ChainProvider {
+	c := config.Get()
+	fullNodes := NewEndpointPool("full node", endpointURLs(c.FullNodeEndpoints()), c.Net.MaxBlockLag, notify)
+	switch c.Provider {
+	case "jsonrpc":
+		SetEndpointPolicies(c.FullNodeEndpoints())
+		return NewJsonRpcProvider(fullNodes)
+	default:
+		if c.Net.EventSource == "full_node" {
+			SetEndpointPolicies(c.FullNodeEndpoints())
+			return NewTronGridProvider(fullNodes, nil)
+		}
+		SetEndpointPolicies(append(append([]config.EndpointConfig{}, c.FullNodeEndpoints()...), c.EventServerEndpoints()...))
+		eventServers := NewEndpointPool("event server", endpointURLs(c.EventServerEndpoints()), c.Net.MaxBlockLag, notify)
+		return NewTronGridProvider(fullNodes, eventServers)
+	}
+}
+
+// endpointURLs returns the urls of the endpoints
+func endpointURLs(endpoints []config.EndpointConfig) []string {
+	urls := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		urls = append(urls, endpoint.URL)
+	}
+	return urls
+}
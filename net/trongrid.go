@@ -0,0 +1,249 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"psm-monitor/misc"
+)
+
+// TronGridProvider reads the chain through the TronGrid full node HTTP API and event server.
+type TronGridProvider struct {
+	fullNodes    *EndpointPool
+	eventServers *EndpointPool
+}
+
+// NewTronGridProvider creates a provider, eventServers may be nil,
+// events are then decoded from the raw logs of full node transaction infos.
+func NewTronGridProvider(fullNodes, eventServers *EndpointPool) *TronGridProvider {
+	return &TronGridProvider{fullNodes: fullNodes, eventServers: eventServers}
+}
+
+func (t *TronGridProvider) BlockNumber(ctx context.Context) (uint64, error) {
+	if t.eventServers == nil {
+		block, err := getBlock(ctx, t.fullNodes, "")
+		if err != nil {
+			return 0, err
+		}
+		return block.Number, nil
+	}
+	var result string
+	if err := callJsonRpc(ctx, t.eventServers, "eth_blockNumber", &result); err != nil {
+		return 0, err
+	}
+	return hexutil.DecodeUint64(result)
+}
+
+func (t *TronGridProvider) GetBlock(ctx context.Context, blockNumber uint64) (*Block, error) {
+	return getBlock(ctx, t.fullNodes, strconv.FormatUint(blockNumber, 10))
+}
+
+// getBlock queries a block header by id or number, the latest block if idOrNum is empty
+func getBlock(ctx context.Context, fullNodes *EndpointPool, idOrNum string) (*Block, error) {
+	resData, err := fullNodes.Post(ctx, BlockPath, BlockRequest{IdOrNum: idOrNum, Detail: false}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlock(resData)
+}
+
+func parseBlock(resData []byte) (*Block, error) {
+	var blockRes BlockResponse
+	if err := json.Unmarshal(resData, &blockRes); err != nil {
+		return nil, err
+	}
+	if len(blockRes.BlockID) == 0 {
+		return nil, ErrNoReturn
+	}
+	return &Block{
+		Number:     blockRes.BlockHeader.RawData.Number,
+		Hash:       blockRes.BlockID,
+		ParentHash: blockRes.BlockHeader.RawData.ParentHash,
+		Timestamp:  blockRes.BlockHeader.RawData.Timestamp,
+	}, nil
+}
+
+func (t *TronGridProvider) GetBlockEvents(ctx context.Context, blockNumber uint64) ([]*Event, error) {
+	if t.eventServers == nil {
+		return getTxInfoEvents(ctx, t.fullNodes, blockNumber)
+	}
+	events, err := getEvents(ctx, t.eventServers, fmt.Sprintf(BlockEventsPath, blockNumber))
+	if err != nil {
+		return nil, err
+	}
+	if err := setTransactionIndexes(ctx, t.fullNodes, blockNumber, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// setTransactionIndexes sets the position of the transactions of the events in the block,
+// the event server neither returns it nor keeps the transactions in block order
+func setTransactionIndexes(ctx context.Context, fullNodes *EndpointPool, blockNumber uint64, events []*Event) error {
+	txs := make(map[string]bool)
+	for _, event := range events {
+		txs[event.TransactionHash] = true
+	}
+	if len(txs) < 2 {
+		return nil
+	}
+	txInfos, err := getTxInfos(ctx, fullNodes, blockNumber)
+	if err != nil {
+		return err
+	}
+	txIndexes := make(map[string]uint, len(txInfos))
+	for i, txInfo := range txInfos {
+		txIndexes[txInfo.ID] = uint(i)
+	}
+	for _, event := range events {
+		txIndex, ok := txIndexes[event.TransactionHash]
+		if !ok {
+			return fmt.Errorf("net: tx %s of event %s not in block %d", event.TransactionHash, event.EventName, blockNumber)
+		}
+		event.TransactionIndex = txIndex
+	}
+	return nil
+}
+
+// GetLatestBlockEvents returns the events of the latest block, it is only served by the event server
+func (t *TronGridProvider) GetLatestBlockEvents(ctx context.Context) ([]*Event, error) {
+	if t.eventServers == nil {
+		return nil, ErrUnsupported
+	}
+	return getEvents(ctx, t.eventServers, LatestEventsPath)
+}
+
+// getTxInfoEvents decodes the events of a block from the raw logs of its transaction infos,
+// logs the decoder does not know are skipped.
+func getTxInfoEvents(ctx context.Context, fullNodes *EndpointPool, blockNumber uint64) ([]*Event, error) {
+	if logDecoder == nil {
+		return nil, fmt.Errorf("net: no log decoder set: %w", ErrUnsupported)
+	}
+	txInfos, err := getTxInfos(ctx, fullNodes, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0)
+	for txIndex, txInfo := range txInfos {
+		for i, log := range txInfo.Log {
+			name, signature, result, ok := logDecoder(log)
+			if !ok {
+				continue
+			}
+			events = append(events, &Event{
+				BlockNumber:      txInfo.BlockNumber,
+				BlockTimestamp:   txInfo.BlockTimeStamp,
+				Address:          misc.ToTronAddr(log.Address),
+				TransactionIndex: uint(txIndex),
+				LogIndex:         uint(i),
+				EventName:        name,
+				Event:            signature,
+				TransactionHash:  txInfo.ID,
+				Result:           result,
+			})
+		}
+	}
+	return events, nil
+}
+
+// getTxInfos returns the transaction infos of a block in block order
+func getTxInfos(ctx context.Context, fullNodes *EndpointPool, blockNumber uint64) ([]*TransactionInfo, error) {
+	resData, err := fullNodes.Post(ctx, TxInfoPath, TransactionInfoRequest{Num: blockNumber}, nil)
+	if err != nil {
+		return nil, err
+	}
+	// a block without transactions is returned as an empty object
+	var txInfos []*TransactionInfo
+	if trimmed := bytes.TrimSpace(resData); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(resData, &txInfos); err != nil {
+			return nil, err
+		}
+	}
+	return txInfos, nil
+}
+
+func getEvents(ctx context.Context, eventServers *EndpointPool, path string) ([]*Event, error) {
+	var allEvents []*Event
+	err := eventServers.Do(ctx, func(url string) error {
+		allEvents = make([]*Event, 0)
+		events := Events{}
+		// the next links point to the same event server as the first page
+		events.Meta.Links.Next = url + path
+		for len(events.Meta.Links.Next) != 0 {
+			rspData, err := get(ctx, events.Meta.Links.Next, nil, 1)
+			if err != nil {
+				return err
+			}
+			events = Events{}
+			if err := json.Unmarshal(rspData, &events); err != nil {
+				return err
+			}
+			allEvents = append(allEvents, events.Data...)
+		}
+		return nil
+	})
+	return allEvents, err
+}
+
+func (t *TronGridProvider) Trigger(ctx context.Context, addr, selector, param string) (string, error) {
+	resData, err := t.fullNodes.Post(ctx, TriggerPath, TriggerRequest{
+		OwnerAddress:     "T9yD14Nj9j7xAB4dbGeiX9h8unkKHxuWwb",
+		ContractAddress:  addr,
+		FunctionSelector: selector,
+		Parameter:        param,
+		Visible:          true,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	var queryRes TriggerResponse
+	_ = json.Unmarshal(resData, &queryRes)
+	if !queryRes.RpcResult.TriggerResult {
+		return "", ErrQueryFailed
+	}
+	if len(queryRes.Result) > 0 {
+		return queryRes.Result[0], nil
+	}
+	return "", ErrNoReturn
+}
+
+func (t *TronGridProvider) GetTransaction(ctx context.Context, id string) (*Transaction, error) {
+	resData, err := t.fullNodes.Post(ctx, TransactionPath, TransactionRequest{Value: id, Visible: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var txRes TransactionResponse
+	if err := json.Unmarshal(resData, &txRes); err != nil {
+		return nil, err
+	}
+	if len(txRes.TxID) == 0 || len(txRes.RawData.Contract) == 0 {
+		return nil, ErrNoReturn
+	}
+	value := txRes.RawData.Contract[0].Parameter.Value
+	return &Transaction{Hash: txRes.TxID, From: value.OwnerAddress, To: value.ContractAddress}, nil
+}
+
+// CheckHealth probes the block height of every full node and event server
+func (t *TronGridProvider) CheckHealth(ctx context.Context) {
+	t.fullNodes.CheckHealth(ctx, probeFullNodeBlockNumber)
+	if t.eventServers != nil {
+		t.eventServers.CheckHealth(ctx, probeJsonRpcBlockNumber)
+	}
+}
+
+func probeFullNodeBlockNumber(ctx context.Context, url string) (uint64, error) {
+	resData, err := post(ctx, url+BlockPath, BlockRequest{Detail: false}, nil, 1)
+	if err != nil {
+		return 0, err
+	}
+	block, err := parseBlock(resData)
+	if err != nil {
+		return 0, err
+	}
+	return block.Number, nil
+}
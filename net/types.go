@@ -1,5 +1,10 @@
 package net
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type TriggerRequest struct {
 	OwnerAddress     string `json:"owner_address"`
 	ContractAddress  string `json:"contract_address"`
@@ -15,24 +20,73 @@ type TriggerResponse struct {
 	} `json:"result"`
 }
 
-type JsonRpcMessage struct {
-	Version string `json:"jsonrpc,omitempty"`
-	ID      int64  `json:"id,omitempty"`
-	Method  string `json:"method,omitempty"`
-	Params  string `json:"params,omitempty"`
-	Error   error  `json:"error,omitempty"`
-	Result  string `json:"result,omitempty"`
+type JsonRpcRequest struct {
+	Version string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type JsonRpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *JsonRpcError   `json:"error,omitempty"`
+}
+
+type JsonRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *JsonRpcError) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+type JsonRpcBlock struct {
+	Number     string `json:"number"`
+	Hash       string `json:"hash"`
+	ParentHash string `json:"parentHash"`
+	Timestamp  string `json:"timestamp"`
+}
+
+type JsonRpcTransaction struct {
+	Hash string `json:"hash"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// JsonRpcLog is a raw log returned by eth_getLogs, Log carries the address, topics and data
+type JsonRpcLog struct {
+	Log
+	BlockNumber      string `json:"blockNumber"`
+	TransactionHash  string `json:"transactionHash"`
+	TransactionIndex string `json:"transactionIndex"`
+	LogIndex         string `json:"logIndex"`
+	Removed          bool   `json:"removed"`
 }
 
 type Event struct {
-	BlockNumber     uint64            `json:"block_number"`
-	BlockTimestamp  int64             `json:"block_timestamp"`
-	Address         string            `json:"contract_address"`
-	LogIndex        uint              `json:"event_index"`
-	EventName       string            `json:"event_name"`
-	Event           string            `json:"event"`
-	TransactionHash string            `json:"transaction_id"`
-	Result          map[string]string `json:"result"`
+	BlockNumber    uint64 `json:"block_number"`
+	BlockTimestamp int64  `json:"block_timestamp"`
+	Address        string `json:"contract_address"`
+	// TransactionIndex is the position of the transaction in the block, set by the providers,
+	// LogIndex is the position of the log in the transaction, or in the block for JSON-RPC
+	TransactionIndex uint                   `json:"-"`
+	LogIndex         uint                   `json:"event_index"`
+	EventName        string                 `json:"event_name"`
+	Event            string                 `json:"event"`
+	TransactionHash  string                 `json:"transaction_id"`
+	Result           map[string]interface{} `json:"result"`
+}
+
+type TransactionInfoRequest struct {
+	Num uint64 `json:"num"`
+}
+
+type TransactionInfo struct {
+	ID             string `json:"id"`
+	BlockNumber    uint64 `json:"blockNumber"`
+	BlockTimeStamp int64  `json:"blockTimeStamp"`
+	Log            []*Log `json:"log"`
 }
 
 type Events struct {
@@ -47,5 +101,52 @@ type Events struct {
 	}
 }
 
+type Transaction struct {
+	Hash string
+	// From is the owner address of the transaction
+	From string
+	// To is the called contract address, empty if the transaction calls no contract
+	To string
+}
+
+type TransactionRequest struct {
+	Value   string `json:"value"`
+	Visible bool   `json:"visible"`
+}
+
+type TransactionResponse struct {
+	TxID    string `json:"txID"`
+	RawData struct {
+		Contract []struct {
+			Parameter struct {
+				Value struct {
+					OwnerAddress    string `json:"owner_address"`
+					ContractAddress string `json:"contract_address"`
+				} `json:"value"`
+			} `json:"parameter"`
+		} `json:"contract"`
+	} `json:"raw_data"`
+}
+
 type Block struct {
+	Number     uint64
+	Hash       string
+	ParentHash string
+	Timestamp  int64
+}
+
+type BlockRequest struct {
+	IdOrNum string `json:"id_or_num"`
+	Detail  bool   `json:"detail"`
+}
+
+type BlockResponse struct {
+	BlockID     string `json:"blockID"`
+	BlockHeader struct {
+		RawData struct {
+			Number     uint64 `json:"number"`
+			ParentHash string `json:"parentHash"`
+			Timestamp  int64  `json:"timestamp"`
+		} `json:"raw_data"`
+	} `json:"block_header"`
 }
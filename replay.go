@@ -0,0 +1,76 @@
+package main
+
+import (
+	"psm-monitor/abi"
+	"psm-monitor/config"
+	"psm-monitor/misc"
+	"psm-monitor/monitor"
+	"psm-monitor/net"
+	"psm-monitor/slack"
+
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runReplay runs the event handlers of all monitors over a historical block range,
+// prices are not read at the replayed blocks, so USD values and thresholds use the present prices and are marked so,
+// usage: psm-monitor [--config file] replay --from X --to Y [--dry-run] [--output file]
+func runReplay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "first block to replay")
+	to := fs.Uint64("to", 0, "last block to replay")
+	dryRun := fs.Bool("dry-run", false, "print slack messages instead of sending them to the webhook")
+	output := fs.String("output", "", "file the dry-run messages are written to, stdout if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == 0 || *to < *from {
+		return fmt.Errorf("invalid block range [%d, %d]", *from, *to)
+	}
+
+	if *dryRun {
+		var w io.Writer = os.Stdout
+		if len(*output) != 0 {
+			file, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+		slack.SetOutput(w)
+		defer slack.SetOutput(nil)
+	}
+
+	// the monitors start without a cron, only their event handlers are used,
+	// so the present state is neither read nor reported to slack
+	net.SetLogDecoder(abi.DecodeLog)
+	chain = net.NewChainProvider(nil)
+	trackedEvent = make(map[string]func(ctx context.Context, event *net.Event))
+	monitor.StartPSM(ctx, nil, chain, trackedEvent)
+	monitor.StartSUN(ctx, nil, chain, trackedEvent)
+	monitor.StartJST(ctx, nil, chain, trackedEvent)
+	monitor.StartUSDD(ctx, nil, chain, trackedEvent)
+
+	workers := config.Get().Track.CatchUpWorkers
+	if workers <= 0 {
+		workers = defaultCatchUpWorkers
+	}
+	var replayErr error
+	fetchInOrder(ctx, *from, *to, workers, config.Get().Track.CatchUpRate, func(blockNumber uint64, fetched *fetchedBlock) bool {
+		if fetched.err != nil {
+			replayErr = fmt.Errorf("fetch block %d: %w", blockNumber, fetched.err)
+			return false
+		}
+		handleEvents(ctx, fetched.events)
+		misc.Info("Replay task report", fmt.Sprintf("block %d is replayed, has %d events", blockNumber, len(fetched.events)))
+		return true
+	})
+	if replayErr == nil && ctx.Err() != nil {
+		replayErr = ctx.Err()
+	}
+	return replayErr
+}
@@ -1,9 +1,12 @@
 package slack
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"psm-monitor/config"
@@ -15,7 +18,20 @@ type Message struct {
 	Text string `json:"text"`
 }
 
-func SendMsg(topic, format string, a ...any) {
+var (
+	// output receives the messages instead of the webhooks when set, used by dry runs
+	output     io.Writer
+	outputLock sync.Mutex
+)
+
+// SetOutput redirects all messages to w instead of the Slack webhooks, nil restores the webhooks.
+func SetOutput(w io.Writer) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	output = w
+}
+
+func SendMsg(ctx context.Context, topic, format string, a ...any) {
 	content := format
 	if len(a) != 0 {
 		content = fmt.Sprintf(format, a...)
@@ -23,18 +39,25 @@ func SendMsg(topic, format string, a ...any) {
 	msg := &Message{
 		Text: fmt.Sprintf("%s [%s] %s", topic, time.Now().Format("01-02 15:04:05"), content),
 	}
-	if _, err := net.Post(config.Get().SlackWebhook, msg, checkIfResponseOk); err != nil {
-		misc.Warn("Send slack message", fmt.Sprintf("content=\"%s\" res=failed reason=\"%s\"", msg, err.Error()))
-	} else {
-		misc.Info("Send slack message", fmt.Sprintf("content=\"%s\" res=success", msg))
-	}
+	send(ctx, config.Get().SlackWebhook, msg)
 }
 
-func ReportFee(message string) {
+func ReportFee(ctx context.Context, message string) {
 	msg := &Message{
 		Text: message,
 	}
-	if _, err := net.Post(config.Get().FeeSlackWebhook, msg, checkIfResponseOk); err != nil {
+	send(ctx, config.Get().FeeSlackWebhook, msg)
+}
+
+func send(ctx context.Context, webhook string, msg *Message) {
+	outputLock.Lock()
+	if output != nil {
+		_, _ = fmt.Fprintln(output, msg.Text)
+		outputLock.Unlock()
+		return
+	}
+	outputLock.Unlock()
+	if _, err := net.Post(ctx, webhook, msg, checkIfResponseOk); err != nil {
 		misc.Warn("Send slack message", fmt.Sprintf("content=\"%s\" res=failed reason=\"%s\"", msg, err.Error()))
 	} else {
 		misc.Info("Send slack message", fmt.Sprintf("content=\"%s\" res=success", msg))
@@ -48,7 +71,7 @@ func checkIfResponseOk(resBody []byte) error {
 	return errors.New("Slack response need ok, but got " + string(resBody))
 }
 
-func ReportPanic(topic string, err error) {
-	SendMsg(":zany_face: [APP]", "Panic happened, doing `%s`, reason `%s`", topic, err.Error())
+func ReportPanic(ctx context.Context, topic string, err error) {
+	SendMsg(ctx, ":zany_face: [APP]", "Panic happened, doing `%s`, reason `%s`", topic, err.Error())
 	// misc.Error("Panic happened", reason)
 }
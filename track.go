@@ -0,0 +1,240 @@
+package main
+
+import (
+	"psm-monitor/config"
+	"psm-monitor/db"
+	"psm-monitor/misc"
+	"psm-monitor/net"
+	"psm-monitor/slack"
+
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// trackCursorID is the primary key of the single cursor row in monitor.db
+	trackCursorID = 1
+
+	defaultHashHistory = 100
+	defaultMaxBackfill = 1_200
+)
+
+var (
+	chain              net.ChainProvider
+	trackedBlockNumber uint64
+	trackedEvent       map[string]func(ctx context.Context, event *net.Event)
+	trackLock          sync.RWMutex
+
+	// trackedHashes keeps the hashes of recently handled blocks for fork detection
+	trackedHashes = make(map[uint64]string)
+	// lastTrackedBlock is the block the cursor points to
+	lastTrackedBlock *net.Block
+
+	// trackStop is closed on shutdown, the tracker stops after the block in hand
+	trackStop = make(chan struct{})
+)
+
+// TrackCursor records the last block whose events were fully handled.
+type TrackCursor struct {
+	ID          uint `gorm:"primaryKey"`
+	BlockNumber uint64
+	BlockHash   string
+	UpdatedAt   time.Time
+}
+
+func initTracker(ctx context.Context) {
+	_ = db.Get().AutoMigrate(&TrackCursor{})
+	confirmedBlockNumber := getConfirmedBlockNumber(ctx)
+
+	var cursor TrackCursor
+	if err := db.Get().Limit(1).Find(&cursor, trackCursorID).Error; err != nil || cursor.BlockNumber == 0 {
+		// no cursor stored yet, start tracking from the confirmed tip
+		trackedBlockNumber = confirmedBlockNumber
+		misc.Info("Track task report", fmt.Sprintf("no stored cursor, start from block %d", trackedBlockNumber))
+		return
+	}
+
+	trackedBlockNumber = cursor.BlockNumber
+	if len(cursor.BlockHash) != 0 {
+		trackedHashes[cursor.BlockNumber] = cursor.BlockHash
+	}
+	maxBackfill := config.Get().Track.MaxBackfill
+	if maxBackfill == 0 {
+		maxBackfill = defaultMaxBackfill
+	}
+	if confirmedBlockNumber > trackedBlockNumber+maxBackfill {
+		skippedFrom := trackedBlockNumber + 1
+		trackedBlockNumber = confirmedBlockNumber - maxBackfill
+		trackedHashes = make(map[uint64]string)
+		slack.SendMsg(ctx, ":zany_face: [APP]", "Stored cursor is too old, blocks `%d` ~ `%d` are skipped",
+			skippedFrom, trackedBlockNumber)
+	}
+	misc.Info("Track task report", fmt.Sprintf("resume from block %d, stored cursor is %d, confirmed is %d",
+		trackedBlockNumber, cursor.BlockNumber, confirmedBlockNumber))
+}
+
+func track(ctx context.Context) {
+	if !trackLock.TryLock() {
+		// never block the cron tick, a catch-up or the previous tick is still running
+		misc.Info("Track task report", "tracker is busy, skip this tick")
+		return
+	}
+	confirmedBlockNumber := getConfirmedBlockNumber(ctx)
+	if trackedBlockNumber == 0 && confirmedBlockNumber != 0 {
+		// the chain was unreachable at startup, start tracking from the confirmed tip
+		trackedBlockNumber = confirmedBlockNumber
+	}
+	if trackedBlockNumber >= confirmedBlockNumber {
+		// confirmed block has already been tracked
+		trackLock.Unlock()
+		misc.Info("Track task report", fmt.Sprintf("block %d is already tracked", trackedBlockNumber))
+		return
+	}
+	if confirmedBlockNumber-trackedBlockNumber > getCatchUpThreshold() {
+		go func() {
+			defer trackLock.Unlock()
+			catchUp(ctx, confirmedBlockNumber)
+		}()
+		return
+	}
+	defer trackLock.Unlock()
+	for trackedBlockNumber < confirmedBlockNumber && !isTrackStopped() {
+		block, err := chain.GetBlock(ctx, trackedBlockNumber+1)
+		if err != nil {
+			misc.Warn("Track task report", fmt.Sprintf("action=\"get block %d\" reason=\"%s\"", trackedBlockNumber+1, err.Error()))
+			return
+		}
+		if parentHash, ok := trackedHashes[trackedBlockNumber]; ok && parentHash != block.ParentHash {
+			// the block we handled before has been replaced, rewind to the common ancestor
+			if err := rewindToCommonAncestor(ctx); err != nil {
+				misc.Warn("Track task report", fmt.Sprintf("action=\"rewind from block %d\" reason=\"%s\"", trackedBlockNumber, err.Error()))
+				return
+			}
+			continue
+		}
+		events, err := chain.GetBlockEvents(ctx, block.Number)
+		if err != nil {
+			misc.Warn("Track task report", fmt.Sprintf("action=\"get block %d events\" reason=\"%s\"", block.Number, err.Error()))
+			return
+		}
+		handleEvents(ctx, events)
+		saveCursor(block)
+		misc.Info("Track task report", fmt.Sprintf("block %d is confirmed, has %d events", block.Number, len(events)))
+	}
+}
+
+func isTrackStopped() bool {
+	select {
+	case <-trackStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopTracker waits for the block in hand to be handled and saves the cursor,
+// it returns false if that does not finish before ctx is done.
+func stopTracker(ctx context.Context) bool {
+	close(trackStop)
+	stopped := make(chan struct{})
+	go func() {
+		trackLock.Lock()
+		defer trackLock.Unlock()
+		if lastTrackedBlock != nil {
+			saveCursor(lastTrackedBlock)
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handleEvents runs the handlers of one block's events in log order
+func handleEvents(ctx context.Context, events []*net.Event) {
+	for _, event := range sortEvents(events) {
+		if f, ok := trackedEvent[event.Address]; ok {
+			f(ctx, event)
+		}
+	}
+}
+
+// getConfirmedBlockNumber returns the highest block that is deep enough to be handled
+func getConfirmedBlockNumber(ctx context.Context) uint64 {
+	latestBlockNumber, err := chain.BlockNumber(ctx)
+	if err != nil {
+		misc.Warn("Track task report", fmt.Sprintf("action=\"get latest block number\" reason=\"%s\"", err.Error()))
+		return 0
+	}
+	confirmations := config.Get().Track.Confirmations
+	if latestBlockNumber < confirmations {
+		return 0
+	}
+	return latestBlockNumber - confirmations
+}
+
+// rewindToCommonAncestor walks back the remembered hashes until one still matches the canonical chain,
+// the events of all blocks above it will be handled again.
+// When the fork is deeper than the remembered hashes, it rewinds to the newest block without a remembered hash,
+// which cannot be verified, so the events handled up to that block may be stale.
+// When the tracked block itself still matches, nothing is replaced and it fails, the parent hash of the next block
+// came from an endpoint that disagrees or lags, and the next tick tries again.
+func rewindToCommonAncestor(ctx context.Context) error {
+	replacedBlockNumber := trackedBlockNumber
+	number := trackedBlockNumber
+	isVerified := false
+	for {
+		hash, ok := trackedHashes[number]
+		if !ok {
+			break
+		}
+		block, err := chain.GetBlock(ctx, number)
+		if err != nil {
+			return err
+		}
+		if block.Hash == hash {
+			if number == replacedBlockNumber {
+				return fmt.Errorf("tracked block %d still matches %s, the parent hash of the next block disagrees", number, hash)
+			}
+			isVerified = true
+			break
+		}
+		number--
+	}
+	for replaced := number + 1; replaced <= replacedBlockNumber; replaced++ {
+		delete(trackedHashes, replaced)
+	}
+	trackedBlockNumber = number
+	if !isVerified {
+		slack.SendMsg(ctx, ":zany_face: [APP]", "Chain fork is deeper than remembered blocks, blocks `%d` ~ `%d` were replaced, re-handling them, "+
+			"block `%d` and earlier could not be verified, their events may be stale",
+			trackedBlockNumber+1, replacedBlockNumber, trackedBlockNumber)
+		return nil
+	}
+	slack.SendMsg(ctx, ":zany_face: [APP]", "Chain fork detected, blocks `%d` ~ `%d` were replaced, re-handling them",
+		trackedBlockNumber+1, replacedBlockNumber)
+	return nil
+}
+
+// saveCursor advances the tracked block, it must only be called after all handlers of the block returned
+func saveCursor(block *net.Block) {
+	trackedBlockNumber, lastTrackedBlock = block.Number, block
+	trackedHashes[block.Number] = block.Hash
+	hashHistory := config.Get().Track.HashHistory
+	if hashHistory == 0 {
+		hashHistory = defaultHashHistory
+	}
+	if block.Number >= hashHistory {
+		delete(trackedHashes, block.Number-hashHistory)
+	}
+
+	cursor := TrackCursor{ID: trackCursorID, BlockNumber: block.Number, BlockHash: block.Hash, UpdatedAt: time.Now()}
+	if err := db.Get().Save(&cursor).Error; err != nil {
+		misc.Warn("Track task report", fmt.Sprintf("action=\"save cursor %d\" reason=\"%s\"", block.Number, err.Error()))
+	}
+}
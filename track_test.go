@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"psm-monitor/net"
+	"psm-monitor/slack"
+)
+
+// fakeChain serves block hashes by number
+type fakeChain struct {
+	net.ChainProvider
+	hashes map[uint64]string
+}
+
+func (f *fakeChain) GetBlock(_ context.Context, blockNumber uint64) (*net.Block, error) {
+	return &net.Block{Number: blockNumber, Hash: f.hashes[blockNumber]}, nil
+}
+
+func TestRewindToCommonAncestor(t *testing.T) {
+	var out bytes.Buffer
+	slack.SetOutput(&out)
+	defer slack.SetOutput(nil)
+	defer func() { chain, trackedBlockNumber, trackedHashes = nil, 0, make(map[uint64]string) }()
+
+	// the tracked block still matches, only the endpoint serving the next block disagrees
+	chain = &fakeChain{hashes: map[uint64]string{99: "h99", 100: "h100"}}
+	trackedBlockNumber, trackedHashes = 100, map[uint64]string{99: "h99", 100: "h100"}
+	if err := rewindToCommonAncestor(context.Background()); err == nil {
+		t.Error("rewindToCommonAncestor() succeeds without replaced blocks")
+	}
+	if trackedBlockNumber != 100 || len(trackedHashes) != 2 || out.Len() != 0 {
+		t.Errorf("tracked block = %d, hashes = %v, slack = %q", trackedBlockNumber, trackedHashes, out.String())
+	}
+
+	// block 100 was replaced, 99 is the common ancestor
+	chain = &fakeChain{hashes: map[uint64]string{99: "h99", 100: "h100'"}}
+	if err := rewindToCommonAncestor(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := trackedHashes[100]; trackedBlockNumber != 99 || ok || !strings.Contains(out.String(), "blocks `100` ~ `100` were replaced") {
+		t.Errorf("tracked block = %d, hashes = %v, slack = %q", trackedBlockNumber, trackedHashes, out.String())
+	}
+}